@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/exchangedataset/exd-cli/format"
+	"github.com/exchangedataset/exdgo"
+)
+
+const (
+	fieldOpen           = "open"
+	fieldHigh           = "high"
+	fieldLow            = "low"
+	fieldClose          = "close"
+	fieldVolume         = "volume"
+	fieldCount          = "count"
+	fieldVWAP           = "vwap"
+	fieldCloseTimestamp = "close_timestamp"
+)
+
+// Fields of lines `bars` outputs in order
+var barsFields = []string{
+	format.FieldExchange, format.FieldChannel, format.FieldTimestamp, fieldSymbol,
+	fieldOpen, fieldHigh, fieldLow, fieldClose, fieldVolume, fieldCount, fieldVWAP, fieldCloseTimestamp,
+}
+
+// Definition of lines `bars` outputs, used to determine types of columns
+var barsDefinition = format.Definitions{"bars": {"bars": {
+	fieldSymbol:         "string",
+	fieldOpen:           "float",
+	fieldHigh:           "float",
+	fieldLow:            "float",
+	fieldClose:          "float",
+	fieldVolume:         "float",
+	fieldCount:          "int",
+	fieldVWAP:           "float",
+	fieldCloseTimestamp: "timestamp",
+}}}
+
+// barFieldNames is names of fields in trade messages of a channel.
+type barFieldNames struct {
+	Symbol string `json:"symbol"`
+	Price  string `json:"price"`
+	Size   string `json:"size"`
+}
+
+// bar is an OHLCV bar of a symbol being aggregated.
+type bar struct {
+	exchange string
+	channel  string
+	symbol   string
+	// Start of the interval for time bars, otherwise the timestamp of the first trade
+	start int64
+	// Timestamp of the last trade
+	last     int64
+	open     float64
+	high     float64
+	low      float64
+	close    float64
+	volume   float64
+	count    int64
+	notional float64
+}
+
+// add adds a trade to the bar.
+func (b *bar) add(timestamp int64, price float64, size float64) {
+	if b.count == 0 {
+		b.open = price
+		b.high = price
+		b.low = price
+	}
+	b.high = math.Max(b.high, price)
+	b.low = math.Min(b.low, price)
+	b.close = price
+	b.volume += size
+	b.notional += price * size
+	b.count++
+	b.last = timestamp
+}
+
+// writeValues sets values of the bar to `values`.
+func (b *bar) writeValues(values map[string]interface{}) {
+	values[format.FieldExchange] = b.exchange
+	values[format.FieldChannel] = b.channel
+	values[format.FieldTimestamp] = b.start
+	values[fieldSymbol] = b.symbol
+	values[fieldOpen] = b.open
+	values[fieldHigh] = b.high
+	values[fieldLow] = b.low
+	values[fieldClose] = b.close
+	values[fieldVolume] = b.volume
+	values[fieldCount] = b.count
+	if b.volume != 0 {
+		values[fieldVWAP] = b.notional / b.volume
+	}
+	values[fieldCloseTimestamp] = b.last
+}
+
+// barAggregator aggregates trades into bars.
+// Exactly one of `interval`, `ticks` and `volume` is set to determine when a bar is closed.
+type barAggregator struct {
+	// Duration of time bars
+	interval int64
+	// Number of trades in tick bars
+	ticks int64
+	// Volume of volume bars
+	volume float64
+	// Default names of fields
+	names barFieldNames
+	// Names of fields by exchange and channel
+	nameMap map[string]map[string]barFieldNames
+	// Open bars by exchange, channel and symbol joined with tab
+	bars map[string]*bar
+	// Keys of `bars` in the order of creation so that bars are output in a stable order
+	order []string
+	// Start of the current interval of time bars
+	current int64
+	// Called when a bar is closed
+	emit func(b *bar) error
+}
+
+// namesOf returns names of fields for the channel.
+func (a *barAggregator) namesOf(exchange string, channel string) barFieldNames {
+	names := a.names
+	if override, ok := a.nameMap[exchange][channel]; ok {
+		if override.Symbol != "" {
+			names.Symbol = override.Symbol
+		}
+		if override.Price != "" {
+			names.Price = override.Price
+		}
+		if override.Size != "" {
+			names.Size = override.Size
+		}
+	}
+	return names
+}
+
+// closeAll emits all open bars and removes them.
+func (a *barAggregator) closeAll() error {
+	for _, key := range a.order {
+		if serr := a.emit(a.bars[key]); serr != nil {
+			return serr
+		}
+		delete(a.bars, key)
+	}
+	a.order = a.order[:0]
+	return nil
+}
+
+// add adds a trade message to the bar of its symbol.
+func (a *barAggregator) add(exchange string, channel string, timestamp int64, values map[string]interface{}) error {
+	if a.interval > 0 {
+		start := timestamp - timestamp%a.interval
+		if start != a.current {
+			// The trade is in the next interval
+			if serr := a.closeAll(); serr != nil {
+				return serr
+			}
+			a.current = start
+		}
+	}
+	names := a.namesOf(exchange, channel)
+	price, serr := toFloat(values[names.Price])
+	if serr != nil {
+		return fmt.Errorf("%s: %v", names.Price, serr)
+	}
+	size, serr := toFloat(values[names.Size])
+	if serr != nil {
+		return fmt.Errorf("%s: %v", names.Size, serr)
+	}
+	// Some exchanges express the side with the sign of the size
+	size = math.Abs(size)
+	symbol, _ := values[names.Symbol].(string)
+	key := exchange + "\t" + channel + "\t" + symbol
+	b, ok := a.bars[key]
+	if !ok {
+		b = &bar{
+			exchange: exchange,
+			channel:  channel,
+			symbol:   symbol,
+			start:    timestamp,
+		}
+		if a.interval > 0 {
+			b.start = a.current
+		}
+		a.bars[key] = b
+		a.order = append(a.order, key)
+	}
+	b.add(timestamp, price, size)
+	if (a.ticks > 0 && b.count >= a.ticks) || (a.volume > 0 && b.volume >= a.volume) {
+		if serr := a.emit(b); serr != nil {
+			return serr
+		}
+		delete(a.bars, key)
+		for i, k := range a.order {
+			if k == key {
+				a.order = append(a.order[:i], a.order[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func subCmdBars(args []string) (err error) {
+	flg := flag.NewFlagSet("bars", flag.ExitOnError)
+	optFilter := flg.String("filter", "", "JSON. Set names of target exchanges and its trade channels.")
+	optStart := flg.String("start", "", "Datetime. Set a start datetime of the stream. Unix time in nanoseconds, RFC3339, '2020-09-01', '2020-09-01 12:00', 'now', 'today' or 'yesterday' in UTC optionally followed by an offset such as 'now-1h'.")
+	optEnd := flg.String("end", "", "Datetime. Set a end datetime of the stream. Same formats as --start are accepted.")
+	optDuration := flg.String("duration", "", "Optional. Duration. Set the length of the stream instead of --end, such as '6h' or '2d'.")
+	optFormat := flg.String("format", "", "Optinal. String. Set the output format. 'json', 'csv', 'parquet' are supported. Default is 'json'.")
+	optOutput := flg.String("output", "", "Optional. String. Set the path to the file to write output to. {exchange}, {channel}, {date}, {hour}, {minute} and {index} in it are replaced to write to multiple files, {channel} is _none for lines without channels. Required for 'parquet'. Default is stdout.")
+	optInterval := flg.Duration("interval", 0, "Duration. Make time bars of this interval, such as 1s, 1m or 1h.")
+	optTicks := flg.Int64("ticks", 0, "Int. Make tick bars closed every this number of trades. Alternative to --interval.")
+	optVolume := flg.Float64("volume", 0, "Float. Make volume bars closed when the volume reaches this value. Alternative to --interval.")
+	optSymbolField := flg.String("symbol-field", "pair", "Optional. String. Set the name of the field for the symbol in trade messages. Default is 'pair'.")
+	optPriceField := flg.String("price-field", "price", "Optional. String. Set the name of the field for the price in trade messages. Default is 'price'.")
+	optSizeField := flg.String("size-field", "size", "Optional. String. Set the name of the field for the size in trade messages. Default is 'size'.")
+	optFieldMap := flg.String("field-map", "", "Optional. JSON. Override names of fields for channels, such as '{\"bitmex\":{\"trade\":{\"size\":\"amount\"}}}'.")
+	flg.Usage = func() {
+		fmt.Fprintln(flg.Output(), "Usage of bars:")
+		fmt.Fprintln(flg.Output(), "Aggregates trades into OHLCV bars with the number of trades and VWAP.")
+		flg.PrintDefaults()
+	}
+	err = flg.Parse(args)
+	if err != nil {
+		return
+	}
+	// Load config
+	err = initConfig()
+	if err != nil {
+		return
+	}
+	err = installTransport()
+	if err != nil {
+		return
+	}
+	set := 0
+	if *optInterval != 0 {
+		set++
+	}
+	if *optTicks != 0 {
+		set++
+	}
+	if *optVolume != 0 {
+		set++
+	}
+	if set != 1 {
+		return errors.New("exactly one of --interval, --ticks or --volume must be set")
+	}
+	if *optInterval < 0 || *optTicks < 0 || *optVolume < 0 {
+		return errors.New("--interval, --ticks and --volume must be positive")
+	}
+	agg := &barAggregator{
+		interval: int64(*optInterval),
+		ticks:    *optTicks,
+		volume:   *optVolume,
+		names: barFieldNames{
+			Symbol: *optSymbolField,
+			Price:  *optPriceField,
+			Size:   *optSizeField,
+		},
+		bars:    make(map[string]*bar),
+		current: -1,
+	}
+	if *optFieldMap != "" {
+		err = json.Unmarshal([]byte(*optFieldMap), &agg.nameMap)
+		if err != nil {
+			return fmt.Errorf("--field-map is not in JSON: %v", err)
+		}
+	}
+	formatter, err := format.NewOf(*optFormat, barsFields, barsDefinition)
+	if err != nil {
+		return
+	}
+	rrp, err := makeReplayRequestParameter(optFilter, optStart, optEnd, optDuration)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("bars: %v", err)
+		}
+	}()
+	sink, err := newSink(*optOutput, nil, formatter, sinkRotation{}, "")
+	if err != nil {
+		return
+	}
+	defer func() {
+		serr := sink.Close()
+		if serr != nil {
+			if err != nil {
+				err = fmt.Errorf("%v, originally: %v", serr, err)
+			} else {
+				err = serr
+			}
+		}
+	}()
+	buf := new(bytes.Buffer)
+	values := make(map[string]interface{})
+	// Minute of the last bar, the sink is flushed when it changes
+	var lastMinute int64
+	agg.emit = func(b *bar) error {
+		if minute := b.start / int64(time.Minute); minute != lastMinute {
+			if serr := sink.Flush(); serr != nil {
+				return serr
+			}
+			lastMinute = minute
+		}
+		b.writeValues(values)
+		serr := formatter.WriteTo(buf, values)
+		for key := range values {
+			delete(values, key)
+		}
+		if serr != nil {
+			return serr
+		}
+		if serr = sink.Route(b.exchange, b.channel, b.start); serr != nil {
+			return serr
+		}
+		_, serr = sink.Write(buf.Bytes())
+		buf.Reset()
+		return serr
+	}
+
+	req, err := exdgo.Replay(makeClientParam(), rrp)
+	if err != nil {
+		return
+	}
+	itr, err := req.Stream()
+	if err != nil {
+		return
+	}
+	defer func() {
+		serr := itr.Close()
+		if serr != nil {
+			if err != nil {
+				err = fmt.Errorf("%v, originally: %v", serr, err)
+			} else {
+				err = serr
+			}
+		}
+	}()
+	start := rrp.Start.UnixNano()
+	for {
+		line, ok, serr := itr.Next()
+		if !ok {
+			if serr != nil {
+				return serr
+			}
+			break
+		}
+		if line.Type != exdgo.LineTypeMessage || line.Timestamp < start {
+			// Lines before the start are snapshots, they are not trades
+			continue
+		}
+		serr = agg.add(line.Exchange, *line.Channel, line.Timestamp, line.Message.(map[string]interface{}))
+		if serr != nil {
+			return fmt.Errorf("%d: %v", line.Timestamp, serr)
+		}
+	}
+	// Output bars not yet closed
+	err = agg.closeAll()
+	if err != nil {
+		return
+	}
+	return sink.Flush()
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/exchangedataset/exd-cli/format"
+	"github.com/exchangedataset/exdgo"
+)
+
+const fieldSymbol = "symbol"
+
+// bookSide is the one side of a L2 order book.
+type bookSide struct {
+	// Prices sorted from the best to the worst
+	prices []float64
+	// Size for each price
+	sizes map[float64]float64
+	// Reports whether price `a` is better than `b`
+	better func(a, b float64) bool
+}
+
+func newBookSide(better func(a, b float64) bool) *bookSide {
+	s := new(bookSide)
+	s.sizes = make(map[float64]float64)
+	s.better = better
+	return s
+}
+
+// update sets the size of the level at `price`, the level is removed if `size` is zero.
+func (s *bookSide) update(price float64, size float64) {
+	i := sort.Search(len(s.prices), func(i int) bool {
+		return !s.better(s.prices[i], price)
+	})
+	exists := i < len(s.prices) && s.prices[i] == price
+	if size == 0 {
+		if exists {
+			s.prices = append(s.prices[:i], s.prices[i+1:]...)
+			delete(s.sizes, price)
+		}
+		return
+	}
+	if !exists {
+		s.prices = append(s.prices, 0)
+		copy(s.prices[i+1:], s.prices[i:])
+		s.prices[i] = price
+	}
+	s.sizes[price] = size
+}
+
+// orderBook is the L2 order book of a symbol.
+type orderBook struct {
+	exchange string
+	channel  string
+	symbol   string
+	bids     *bookSide
+	asks     *bookSide
+}
+
+func newOrderBook(exchange string, channel string, symbol string) *orderBook {
+	b := new(orderBook)
+	b.exchange = exchange
+	b.channel = channel
+	b.symbol = symbol
+	b.bids = newBookSide(func(a, b float64) bool { return a > b })
+	b.asks = newBookSide(func(a, b float64) bool { return a < b })
+	return b
+}
+
+// writeLevels sets the top `depth` levels of the book to `values`.
+func (b *orderBook) writeLevels(values map[string]interface{}, depth int) {
+	for i := 0; i < depth && i < len(b.bids.prices); i++ {
+		price := b.bids.prices[i]
+		values[bookLevelField("bid", "price", i)] = price
+		values[bookLevelField("bid", "size", i)] = b.bids.sizes[price]
+	}
+	for i := 0; i < depth && i < len(b.asks.prices); i++ {
+		price := b.asks.prices[i]
+		values[bookLevelField("ask", "price", i)] = price
+		values[bookLevelField("ask", "size", i)] = b.asks.sizes[price]
+	}
+}
+
+// bookLevelField returns the name of the field for a level, such as "bid_price_0".
+func bookLevelField(side string, kind string, level int) string {
+	return side + "_" + kind + "_" + strconv.Itoa(level)
+}
+
+// bookFields returns fields of lines `book` outputs in order.
+func bookFields(depth int) []string {
+	fields := []string{format.FieldExchange, format.FieldChannel, format.FieldTimestamp, fieldSymbol}
+	for i := 0; i < depth; i++ {
+		fields = append(fields,
+			bookLevelField("bid", "price", i),
+			bookLevelField("bid", "size", i),
+			bookLevelField("ask", "price", i),
+			bookLevelField("ask", "size", i),
+		)
+	}
+	return fields
+}
+
+// bookDefinition returns the definition of lines `book` outputs, used to determine types of columns.
+func bookDefinition(depth int) format.Definitions {
+	def := map[string]string{fieldSymbol: "string"}
+	for _, field := range bookFields(depth)[4:] {
+		def[field] = "float"
+	}
+	return format.Definitions{"book": {"book": def}}
+}
+
+// toFloat converts a value of a message which could be a string into float64.
+func toFloat(value interface{}) (float64, error) {
+	switch value.(type) {
+	case float64:
+		return value.(float64), nil
+	case int64:
+		return float64(value.(int64)), nil
+	case string:
+		return strconv.ParseFloat(value.(string), 64)
+	}
+	return 0, fmt.Errorf("toFloat: not a number: %v", value)
+}
+
+// bookUpdater applies messages to order books.
+type bookUpdater struct {
+	// Names of fields in messages
+	symbolField string
+	sideField   string
+	priceField  string
+	sizeField   string
+	// Books by exchange, channel and symbol joined with tab
+	books map[string]*orderBook
+	// Keys of `books` in the order of creation so that books are output in a stable order
+	order []string
+}
+
+func newBookUpdater(symbolField string, sideField string, priceField string, sizeField string) *bookUpdater {
+	u := new(bookUpdater)
+	u.symbolField = symbolField
+	u.sideField = sideField
+	u.priceField = priceField
+	u.sizeField = sizeField
+	u.books = make(map[string]*orderBook)
+	return u
+}
+
+// reset removes all books of the exchange, called when the connection to the exchange was lost.
+func (u *bookUpdater) reset(exchange string) {
+	order := u.order[:0]
+	for _, key := range u.order {
+		if u.books[key].exchange == exchange {
+			delete(u.books, key)
+			continue
+		}
+		order = append(order, key)
+	}
+	u.order = order
+}
+
+// apply applies a message (a level update) to the book of its symbol and returns the book.
+func (u *bookUpdater) apply(exchange string, channel string, values map[string]interface{}) (*orderBook, error) {
+	symbol, _ := values[u.symbolField].(string)
+	key := exchange + "\t" + channel + "\t" + symbol
+	book, ok := u.books[key]
+	if !ok {
+		book = newOrderBook(exchange, channel, symbol)
+		u.books[key] = book
+		u.order = append(u.order, key)
+	}
+	price, serr := toFloat(values[u.priceField])
+	if serr != nil {
+		return nil, fmt.Errorf("%s: %v", u.priceField, serr)
+	}
+	size, serr := toFloat(values[u.sizeField])
+	if serr != nil {
+		return nil, fmt.Errorf("%s: %v", u.sizeField, serr)
+	}
+	side, _ := values[u.sideField].(string)
+	switch strings.ToLower(side) {
+	case "buy", "bid", "bids", "b":
+		book.bids.update(price, size)
+	case "sell", "ask", "asks", "a", "s":
+		book.asks.update(price, size)
+	default:
+		return nil, fmt.Errorf("%s: unknown side '%s'", u.sideField, side)
+	}
+	return book, nil
+}
+
+func subCmdBook(args []string) (err error) {
+	flg := flag.NewFlagSet("book", flag.ExitOnError)
+	optFilter := flg.String("filter", "", "JSON. Set names of target exchanges and its order book channels.")
+	optStart := flg.String("start", "", "Datetime. Set a start datetime of the stream. Unix time in nanoseconds, RFC3339, '2020-09-01', '2020-09-01 12:00', 'now', 'today' or 'yesterday' in UTC optionally followed by an offset such as 'now-1h'.")
+	optEnd := flg.String("end", "", "Datetime. Set a end datetime of the stream. Same formats as --start are accepted.")
+	optDuration := flg.String("duration", "", "Optional. Duration. Set the length of the stream instead of --end, such as '6h' or '2d'.")
+	optFormat := flg.String("format", "", "Optinal. String. Set the output format. 'json', 'csv', 'parquet' are supported. Default is 'json'.")
+	optOutput := flg.String("output", "", "Optional. String. Set the path to the file to write output to. {exchange}, {channel}, {date}, {hour}, {minute} and {index} in it are replaced to write to multiple files, {channel} is _none for lines without channels. Required for 'parquet'. Default is stdout.")
+	optDepth := flg.Int("depth", 10, "Optional. Int. Set how many levels of each side will be output. Default is 10.")
+	optInterval := flg.Duration("interval", 0, "Optional. Duration. Output all books at this interval instead of on every update. Default is on every update.")
+	optSymbolField := flg.String("symbol-field", "pair", "Optional. String. Set the name of the field for the symbol in messages. Default is 'pair'.")
+	optSideField := flg.String("side-field", "side", "Optional. String. Set the name of the field for the side in messages. Default is 'side'.")
+	optPriceField := flg.String("price-field", "price", "Optional. String. Set the name of the field for the price in messages. Default is 'price'.")
+	optSizeField := flg.String("size-field", "size", "Optional. String. Set the name of the field for the size in messages, zero removes the level. Default is 'size'.")
+	flg.Usage = func() {
+		fmt.Fprintln(flg.Output(), "Usage of book:")
+		fmt.Fprintln(flg.Output(), "Reconstructs L2 order books from the snapshot and the following updates, and outputs the top levels.")
+		flg.PrintDefaults()
+	}
+	err = flg.Parse(args)
+	if err != nil {
+		return
+	}
+	// Load config
+	err = initConfig()
+	if err != nil {
+		return
+	}
+	err = installTransport()
+	if err != nil {
+		return
+	}
+	depth := *optDepth
+	if depth <= 0 {
+		return errors.New("--depth must be positive")
+	}
+	interval := *optInterval
+	if interval < 0 {
+		return errors.New("--interval must not be negative")
+	}
+	fields := bookFields(depth)
+	formatter, err := format.NewOf(*optFormat, fields, bookDefinition(depth))
+	if err != nil {
+		return
+	}
+	rrp, err := makeReplayRequestParameter(optFilter, optStart, optEnd, optDuration)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("book: %v", err)
+		}
+	}()
+	cp := makeClientParam()
+	sink, err := newSink(*optOutput, nil, formatter, sinkRotation{}, "")
+	if err != nil {
+		return
+	}
+	defer func() {
+		serr := sink.Close()
+		if serr != nil {
+			if err != nil {
+				err = fmt.Errorf("%v, originally: %v", serr, err)
+			} else {
+				err = serr
+			}
+		}
+	}()
+	updater := newBookUpdater(*optSymbolField, *optSideField, *optPriceField, *optSizeField)
+	buf := new(bytes.Buffer)
+	values := make(map[string]interface{})
+	// emit writes the book to the sink
+	emit := func(book *orderBook, timestamp int64) error {
+		values[format.FieldExchange] = book.exchange
+		values[format.FieldChannel] = book.channel
+		values[format.FieldTimestamp] = timestamp
+		values[fieldSymbol] = book.symbol
+		book.writeLevels(values, depth)
+		serr := formatter.WriteTo(buf, values)
+		for key := range values {
+			delete(values, key)
+		}
+		if serr != nil {
+			return serr
+		}
+		if serr = sink.Route(book.exchange, book.channel, timestamp); serr != nil {
+			return serr
+		}
+		_, serr = sink.Write(buf.Bytes())
+		buf.Reset()
+		return serr
+	}
+	// emitAll writes all books sampled at `timestamp`
+	emitAll := func(timestamp int64) error {
+		for _, key := range updater.order {
+			if serr := emit(updater.books[key], timestamp); serr != nil {
+				return serr
+			}
+		}
+		return sink.Flush()
+	}
+
+	start := rrp.Start.UnixNano()
+	end := rrp.End.UnixNano()
+	nextSample := start
+	// Minute of the last line, the sink is flushed when it changes
+	lastMinute := start / int64(time.Minute)
+	// The stream begins with the snapshot before `start`, the initial books are built from it
+	initialized := false
+	// emitInitial writes the initial books at `start` once
+	emitInitial := func() error {
+		if initialized {
+			return nil
+		}
+		initialized = true
+		if interval > 0 {
+			return nil
+		}
+		for _, key := range updater.order {
+			if serr := emit(updater.books[key], start); serr != nil {
+				return serr
+			}
+		}
+		return nil
+	}
+
+	req, err := exdgo.Replay(cp, rrp)
+	if err != nil {
+		return
+	}
+	itr, err := req.Stream()
+	if err != nil {
+		return
+	}
+	defer func() {
+		serr := itr.Close()
+		if serr != nil {
+			if err != nil {
+				err = fmt.Errorf("%v, originally: %v", serr, err)
+			} else {
+				err = serr
+			}
+		}
+	}()
+	for {
+		line, ok, serr := itr.Next()
+		if !ok {
+			if serr != nil {
+				return serr
+			}
+			break
+		}
+		if line.Timestamp < start {
+			// A line of the snapshot
+			if line.Type != exdgo.LineTypeMessage {
+				continue
+			}
+			if _, serr := updater.apply(line.Exchange, *line.Channel, line.Message.(map[string]interface{})); serr != nil {
+				return fmt.Errorf("snapshot: %v", serr)
+			}
+			continue
+		}
+		if err = emitInitial(); err != nil {
+			return
+		}
+		for interval > 0 && line.Timestamp >= nextSample {
+			if err = emitAll(nextSample); err != nil {
+				return
+			}
+			nextSample += int64(interval)
+		}
+		if line.Type == exdgo.LineTypeStart {
+			// Books will be sent again after reconnection
+			updater.reset(line.Exchange)
+			continue
+		}
+		if line.Type != exdgo.LineTypeMessage {
+			continue
+		}
+		book, serr := updater.apply(line.Exchange, *line.Channel, line.Message.(map[string]interface{}))
+		if serr != nil {
+			return fmt.Errorf("%d: %v", line.Timestamp, serr)
+		}
+		if interval == 0 {
+			if minute := line.Timestamp / int64(time.Minute); minute != lastMinute {
+				if err = sink.Flush(); err != nil {
+					return
+				}
+				lastMinute = minute
+			}
+			if err = emit(book, line.Timestamp); err != nil {
+				return
+			}
+		}
+	}
+	if err = emitInitial(); err != nil {
+		return
+	}
+	for interval > 0 && nextSample < end {
+		if err = emitAll(nextSample); err != nil {
+			return
+		}
+		nextSample += int64(interval)
+	}
+	return sink.Flush()
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/exchangedataset/exd-cli/config"
+	"github.com/exchangedataset/exd-cli/rapid"
+	"github.com/exchangedataset/exdgo"
+)
+
+const (
+	cacheDirectoryName = "cache"
+	cacheFileExtension = ".gob.gz"
+	// Used if the limit is not configured
+	defaultCacheLimit = 10 * 1024 * 1024 * 1024
+	// Entries are evicted until the size is below this ratio of the limit
+	cacheEvictRatio = 0.9
+)
+
+var regexByteSize = regexp.MustCompile("^([0-9]+)(B|[KMGT]I?B?)?$")
+
+var byteSizeUnits = map[byte]int64{
+	'K': 1 << 10,
+	'M': 1 << 20,
+	'G': 1 << 30,
+	'T': 1 << 40,
+}
+
+// parseByteSize converts a size such as "500M", "10GiB" or "1024" into bytes.
+// Units are always in powers of 1024.
+func parseByteSize(str string) (int64, error) {
+	match := regexByteSize.FindStringSubmatch(strings.ToUpper(str))
+	if match == nil {
+		return 0, fmt.Errorf("parseByteSize: invalid size '%s'", str)
+	}
+	size, serr := strconv.ParseInt(match[1], 10, 64)
+	if serr != nil {
+		return 0, fmt.Errorf("parseByteSize: %v", serr)
+	}
+	if match[2] != "" {
+		if unit, ok := byteSizeUnits[match[2][0]]; ok {
+			if size > math.MaxInt64/unit {
+				return 0, fmt.Errorf("parseByteSize: '%s' is too large", str)
+			}
+			size *= unit
+		}
+	}
+	return size, nil
+}
+
+// formatByteSize formats bytes in a human readable way.
+func formatByteSize(size int64) string {
+	units := "KMGT"
+	if size < 1024 {
+		return fmt.Sprintf("%dB", size)
+	}
+	value := float64(size)
+	i := -1
+	for value >= 1024 && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%ciB", value, units[i])
+}
+
+// cacheEntry is the metadata of an entry in the cache.
+type cacheEntry struct {
+	Key  rapid.CacheKey
+	Path string
+	Size int64
+	// Last time the entry was accessed, used for LRU eviction
+	Accessed time.Time
+}
+
+// minuteCache is the on-disk cache of responses from Filter HTTP endpoint, implementing rapid.Cache.
+// Each entry is a gzipped gob stream of the key followed by lines, stored in the file named after the hash of the key.
+// Modification time of a file is updated on every access so that the least recently used entries will be evicted first.
+type minuteCache struct {
+	dir string
+	// Base URL of the API server set to keys, empty for the official server
+	// Responses from other servers such as a mock server must not be served for the official one
+	baseURL string
+	// Maximum total size of entries in bytes
+	limit int64
+	mutex sync.Mutex
+	// Total size of entries, -1 if not yet calculated
+	size int64
+}
+
+// getCacheDirectory returns the path to the cache directory.
+func getCacheDirectory() (string, error) {
+	configDirPath, _, serr := config.Paths()
+	if serr != nil {
+		return "", serr
+	}
+	return path.Join(configDirPath, cacheDirectoryName), nil
+}
+
+// getCacheLimit returns the cache size limit configured in `c`.
+func getCacheLimit(c *config.Config) (int64, error) {
+	if c == nil || c.CacheLimit == "" {
+		return defaultCacheLimit, nil
+	}
+	return parseByteSize(c.CacheLimit)
+}
+
+// openMinuteCache opens the cache in the cache directory, making it if it does not exist.
+// Entries are stored and looked up for the API server at `baseURL`, which is empty for the official server.
+func openMinuteCache(limit int64, baseURL string) (*minuteCache, error) {
+	dir, serr := getCacheDirectory()
+	if serr != nil {
+		return nil, fmt.Errorf("openMinuteCache: %v", serr)
+	}
+	if serr := os.MkdirAll(dir, 0755); serr != nil {
+		return nil, fmt.Errorf("openMinuteCache: %v", serr)
+	}
+	c := new(minuteCache)
+	c.dir = dir
+	if baseURL != "" && !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	c.baseURL = baseURL
+	c.limit = limit
+	c.size = -1
+	return c, nil
+}
+
+// path returns the path to the file of the entry for `key`.
+func (c *minuteCache) path(key rapid.CacheKey) string {
+	id := fmt.Sprintf("%s\n%s\n%d\n%s", key.Exchange, strings.Join(key.Channels, ","), key.Minute, key.Format)
+	if key.BaseURL != "" {
+		// Entries of the official server keep the same path as before base URLs were introduced
+		id += "\n" + key.BaseURL
+	}
+	hash := sha256.Sum256([]byte(id))
+	name := hex.EncodeToString(hash[:])
+	return path.Join(c.dir, cacheExchangeDirectory(key.Exchange), name[:2], name+cacheFileExtension)
+}
+
+// cacheExchangeDirectory returns the name of the directory for entries of the exchange.
+// Names which are not safe as a path component such as '../x' share a directory, entries are still told apart by the hash.
+func cacheExchangeDirectory(exchange string) string {
+	if !regexExchangeName.MatchString(exchange) {
+		return "_invalid"
+	}
+	return exchange
+}
+
+// Get returns lines stored in the cache.
+// `ok` is false if the entry does not exist.
+func (c *minuteCache) Get(key rapid.CacheKey) (lines []exdgo.StringLine, ok bool, err error) {
+	key.BaseURL = c.baseURL
+	entryPath := c.path(key)
+	f, serr := os.Open(entryPath)
+	if os.IsNotExist(serr) {
+		return nil, false, nil
+	} else if serr != nil {
+		return nil, false, fmt.Errorf("cache get: %v", serr)
+	}
+	defer f.Close()
+	gr, serr := gzip.NewReader(f)
+	if serr != nil {
+		// Broken entry, treat as if it does not exist
+		os.Remove(entryPath)
+		return nil, false, nil
+	}
+	dec := gob.NewDecoder(gr)
+	var stored rapid.CacheKey
+	if serr := dec.Decode(&stored); serr != nil {
+		os.Remove(entryPath)
+		return nil, false, nil
+	}
+	if stored.BaseURL != key.BaseURL {
+		// Never serve responses of another server
+		return nil, false, nil
+	}
+	if serr := dec.Decode(&lines); serr != nil {
+		os.Remove(entryPath)
+		return nil, false, nil
+	}
+	// Mark as recently used
+	now := time.Now()
+	if serr := os.Chtimes(entryPath, now, now); serr != nil {
+		return nil, false, fmt.Errorf("cache get: %v", serr)
+	}
+	return lines, true, nil
+}
+
+// Put stores lines to the cache and evicts entries if the size exceeds the limit.
+func (c *minuteCache) Put(key rapid.CacheKey, lines []exdgo.StringLine) error {
+	key.BaseURL = c.baseURL
+	entryPath := c.path(key)
+	if serr := os.MkdirAll(filepath.Dir(entryPath), 0755); serr != nil {
+		return fmt.Errorf("cache put: %v", serr)
+	}
+	// Write to the temporary file first so that other routines or processes will never read a partial entry
+	tmp, serr := ioutil.TempFile(filepath.Dir(entryPath), "*.tmp")
+	if serr != nil {
+		return fmt.Errorf("cache put: %v", serr)
+	}
+	gw := gzip.NewWriter(tmp)
+	enc := gob.NewEncoder(gw)
+	serr = enc.Encode(key)
+	if serr == nil {
+		serr = enc.Encode(lines)
+	}
+	if cerr := gw.Close(); serr == nil {
+		serr = cerr
+	}
+	var size int64
+	if stat, cerr := tmp.Stat(); serr == nil {
+		serr = cerr
+		if cerr == nil {
+			size = stat.Size()
+		}
+	}
+	if cerr := tmp.Close(); serr == nil {
+		serr = cerr
+	}
+	if serr == nil {
+		serr = os.Rename(tmp.Name(), entryPath)
+	}
+	if serr != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cache put: %v", serr)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.size < 0 {
+		// Calculate the size for the first time, it includes the entry just written
+		entries, serr := c.entries()
+		if serr != nil {
+			return fmt.Errorf("cache put: %v", serr)
+		}
+		c.size = 0
+		for _, entry := range entries {
+			c.size += entry.Size
+		}
+	} else {
+		c.size += size
+	}
+	if c.size > c.limit {
+		if serr := c.evict(int64(float64(c.limit) * cacheEvictRatio)); serr != nil {
+			return fmt.Errorf("cache put: %v", serr)
+		}
+	}
+	return nil
+}
+
+// evict removes the least recently used entries until the total size is below `target`.
+func (c *minuteCache) evict(target int64) error {
+	entries, serr := c.entries()
+	if serr != nil {
+		return serr
+	}
+	c.size = 0
+	for _, entry := range entries {
+		c.size += entry.Size
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Accessed.Before(entries[j].Accessed)
+	})
+	for _, entry := range entries {
+		if c.size <= target {
+			break
+		}
+		if serr := os.Remove(entry.Path); serr != nil && !os.IsNotExist(serr) {
+			return serr
+		}
+		c.size -= entry.Size
+	}
+	return nil
+}
+
+// entries lists all entries in the cache without reading their keys.
+func (c *minuteCache) entries() ([]cacheEntry, error) {
+	entries := make([]cacheEntry, 0)
+	serr := filepath.Walk(c.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed by other process
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(p, cacheFileExtension) {
+			return nil
+		}
+		entries = append(entries, cacheEntry{
+			Path:     p,
+			Size:     info.Size(),
+			Accessed: info.ModTime(),
+		})
+		return nil
+	})
+	if serr != nil {
+		return nil, fmt.Errorf("cache entries: %v", serr)
+	}
+	return entries, nil
+}
+
+// readKey reads the key stored at the head of the entry.
+func (e *cacheEntry) readKey() error {
+	f, serr := os.Open(e.Path)
+	if serr != nil {
+		return serr
+	}
+	defer f.Close()
+	gr, serr := gzip.NewReader(f)
+	if serr != nil {
+		return serr
+	}
+	return gob.NewDecoder(gr).Decode(&e.Key)
+}
+
+func subCmdCache(args []string) (err error) {
+	flg := flag.NewFlagSet("cache", flag.ExitOnError)
+	flg.Usage = func() {
+		fmt.Fprintln(flg.Output(), "Usage of cache:")
+		fmt.Fprintln(flg.Output(), "Manages the local cache of data downloaded by rapid.")
+		fmt.Fprintln(flg.Output(), "Subcommands of cache:")
+		fmt.Fprintln(flg.Output(), "  ls\tList cached entries.")
+		fmt.Fprintln(flg.Output(), "  prune\tRemove cached entries.")
+		fmt.Fprintln(flg.Output(), "  size\tShow the total size of the cache.")
+	}
+	err = flg.Parse(args)
+	if err != nil {
+		return
+	}
+	if flg.NArg() < 1 {
+		flg.Usage()
+		return errors.New("cache: subcommand is missing")
+	}
+	switch flg.Arg(0) {
+	case "ls":
+		return subCmdCacheLs(flg.Args()[1:])
+	case "prune":
+		return subCmdCachePrune(flg.Args()[1:])
+	case "size":
+		return subCmdCacheSize(flg.Args()[1:])
+	default:
+		return fmt.Errorf("cache: unknown subcommand '%s'", flg.Arg(0))
+	}
+}
+
+func subCmdCacheLs(args []string) (err error) {
+	flg := flag.NewFlagSet("cache ls", flag.ExitOnError)
+	err = flg.Parse(args)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("cache ls: %v", err)
+		}
+	}()
+	c, err := openMinuteCache(defaultCacheLimit, "")
+	if err != nil {
+		return
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return
+	}
+	for i := range entries {
+		if serr := entries[i].readKey(); serr != nil {
+			// Broken or being removed, skip
+			continue
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].Key, entries[j].Key
+		if a.Exchange != b.Exchange {
+			return a.Exchange < b.Exchange
+		}
+		return a.Minute < b.Minute
+	})
+	for _, entry := range entries {
+		if entry.Key.Exchange == "" {
+			continue
+		}
+		_, err = fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Key.Exchange,
+			strings.Join(entry.Key.Channels, ","),
+			time.Unix(entry.Key.Minute*60, 0).UTC().Format(time.RFC3339),
+			entry.Key.Format,
+			formatByteSize(entry.Size),
+			entry.Accessed.Format(time.RFC3339),
+		)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func subCmdCachePrune(args []string) (err error) {
+	flg := flag.NewFlagSet("cache prune", flag.ExitOnError)
+	optOlderThan := flg.Duration("older-than", 0, "Optional. Duration. Remove only entries not accessed for this duration. Default is to remove all.")
+	err = flg.Parse(args)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("cache prune: %v", err)
+		}
+	}()
+	c, err := openMinuteCache(defaultCacheLimit, "")
+	if err != nil {
+		return
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return
+	}
+	threshold := time.Now().Add(-*optOlderThan)
+	var removed int
+	var freed int64
+	for _, entry := range entries {
+		if entry.Accessed.After(threshold) {
+			continue
+		}
+		if serr := os.Remove(entry.Path); serr != nil && !os.IsNotExist(serr) {
+			return serr
+		}
+		removed++
+		freed += entry.Size
+	}
+	_, err = fmt.Printf("Removed %d entries, %s freed\n", removed, formatByteSize(freed))
+	return
+}
+
+func subCmdCacheSize(args []string) (err error) {
+	flg := flag.NewFlagSet("cache size", flag.ExitOnError)
+	err = flg.Parse(args)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("cache size: %v", err)
+		}
+	}()
+	c, err := openMinuteCache(defaultCacheLimit, "")
+	if err != nil {
+		return
+	}
+	entries, err := c.entries()
+	if err != nil {
+		return
+	}
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+	}
+	_, err = fmt.Printf("%s in %d entries (%s)\n", formatByteSize(size), len(entries), c.dir)
+	return
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/exchangedataset/exd-cli/rapid"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		str  string
+		want int64
+	}{
+		{"1024", 1024},
+		{"500M", 500 << 20},
+		{"10GiB", 10 << 30},
+		{"2tb", 2 << 40},
+		{"8388607T", 8388607 << 40},
+	}
+	for _, test := range tests {
+		got, serr := parseByteSize(test.str)
+		if serr != nil {
+			t.Errorf("parseByteSize(%q): %v", test.str, serr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseByteSize(%q) = %d, want %d", test.str, got, test.want)
+		}
+	}
+	for _, str := range []string{"", "1.5G", "-1", "10X", "8388608T", "9223372036854775808", "99999999999999999G"} {
+		if got, serr := parseByteSize(str); serr == nil {
+			t.Errorf("parseByteSize(%q) = %d, want an error", str, got)
+		}
+	}
+}
+
+func TestMinuteCachePath(t *testing.T) {
+	c := &minuteCache{dir: "cache"}
+	for _, exchange := range []string{"../../etc", "/tmp", "a/b", ".."} {
+		got := c.path(rapidCacheKey(exchange))
+		if rel, serr := filepath.Rel("cache", got); serr != nil || strings.HasPrefix(rel, "..") || strings.Count(rel, "/") != 2 {
+			t.Errorf("entry of '%s' is at %s, outside of the directory of the exchange", exchange, got)
+		}
+	}
+	if a, b := c.path(rapidCacheKey("../a")), c.path(rapidCacheKey("../b")); a == b {
+		t.Errorf("entries of different exchanges are at the same path %s", a)
+	}
+}
+
+// TestMockRapidCacheError checks that the download does not fail when entries can not be stored.
+func TestMockRapidCacheError(t *testing.T) {
+	_, dir := startMockServer(t)
+	cacheDir, serr := getCacheDirectory()
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	if serr := os.MkdirAll(cacheDir, 0755); serr != nil {
+		t.Fatal(serr)
+	}
+	// Directories for entries can not be made
+	if serr := ioutil.WriteFile(filepath.Join(cacheDir, "bitmex"), nil, 0644); serr != nil {
+		t.Fatal(serr)
+	}
+	out := runMock(t, dir, subCmdRapid,
+		"--filter", `{"bitmex":["trade"]}`, "--start", mockStart, "--end", mockEnd, "--retry-wait", "1ms")
+	if lines := strings.Count(out, "\n"); lines != 18 {
+		t.Errorf("%d lines are written, want 18", lines)
+	}
+}
+
+func rapidCacheKey(exchange string) rapid.CacheKey {
+	return rapid.CacheKey{Exchange: exchange, Channels: []string{"trade"}, Minute: 26648640, Format: "json"}
+}
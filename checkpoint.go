@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/exchangedataset/exd-cli/format"
+)
+
+// rapidCheckpoint records how far `rapid` has written its output so that the download can be resumed.
+type rapidCheckpoint struct {
+	Filter map[string][]string `json:"filter"`
+	// Range resolved when the download started, in unixtime in nanoseconds
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// --start, --end and --duration as given, relative datetimes such as 'now-1h' are compared as they are
+	// Empty in checkpoints written by older versions
+	StartOption    string   `json:"start_option,omitempty"`
+	EndOption      string   `json:"end_option,omitempty"`
+	DurationOption string   `json:"duration_option,omitempty"`
+	Format         string   `json:"format"`
+	Fields         []string `json:"fields"`
+	Where          string   `json:"where,omitempty"`
+	// Options of timestamps, empty if not set
+	TimeFormat string `json:"time_format,omitempty"`
+	Timezone   string `json:"timezone,omitempty"`
+	// Minute (unixtime / 60) of the data which has not yet been written.
+	NextMinute int64 `json:"next_minute"`
+	// Sizes of output files by path when the checkpoint was saved, files are truncated to them on resume.
+	// Nil in checkpoints written by older versions or for stdout
+	Offsets map[string]int64 `json:"offsets"`
+}
+
+// loadRapidCheckpoint reads the checkpoint file at `path`.
+func loadRapidCheckpoint(path string) (*rapidCheckpoint, error) {
+	data, serr := ioutil.ReadFile(path)
+	if serr != nil {
+		return nil, fmt.Errorf("loadRapidCheckpoint: %v", serr)
+	}
+	cp := new(rapidCheckpoint)
+	serr = json.Unmarshal(data, cp)
+	if serr != nil {
+		return nil, fmt.Errorf("loadRapidCheckpoint: %v", serr)
+	}
+	return cp, nil
+}
+
+// recordOffsets records sizes of files the sink has written so far.
+// The sink must have been synced before.
+func (cp *rapidCheckpoint) recordOffsets(sink format.Sink) error {
+	so, ok := sink.(sinkOffsetter)
+	if !ok {
+		// Lines written to stdout can not be removed
+		cp.Offsets = nil
+		return nil
+	}
+	offsets, serr := so.Offsets()
+	if serr != nil {
+		return fmt.Errorf("checkpoint: %v", serr)
+	}
+	cp.Offsets = offsets
+	return nil
+}
+
+// save writes the checkpoint to `path` atomically so that a crash will never leave a broken checkpoint.
+func (cp *rapidCheckpoint) save(path string) error {
+	marshaled, serr := json.Marshal(cp)
+	if serr != nil {
+		return fmt.Errorf("checkpoint save: %v", serr)
+	}
+	tmp, serr := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if serr != nil {
+		return fmt.Errorf("checkpoint save: %v", serr)
+	}
+	_, serr = tmp.Write(marshaled)
+	if cerr := tmp.Close(); serr == nil {
+		serr = cerr
+	}
+	if serr != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("checkpoint save: %v", serr)
+	}
+	serr = os.Rename(tmp.Name(), path)
+	if serr != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("checkpoint save: %v", serr)
+	}
+	return nil
+}
+
+// matches checks if the checkpoint was made by the run with the same parameters as `other`.
+// Ranges are compared by the options as given, since relative datetimes are resolved to different times on every run.
+func (cp *rapidCheckpoint) matches(other *rapidCheckpoint) error {
+	if !reflect.DeepEqual(cp.Filter, other.Filter) {
+		return fmt.Errorf("checkpoint is for a different filter")
+	}
+	if cp.StartOption == "" && cp.EndOption == "" && cp.DurationOption == "" {
+		// Written by older versions
+		if cp.Start != other.Start || cp.End != other.End {
+			return fmt.Errorf("checkpoint is for a different range %d-%d", cp.Start, cp.End)
+		}
+	} else if cp.StartOption != other.StartOption || cp.EndOption != other.EndOption || cp.DurationOption != other.DurationOption {
+		return fmt.Errorf("checkpoint is for a different range --start '%s' --end '%s' --duration '%s'", cp.StartOption, cp.EndOption, cp.DurationOption)
+	}
+	if cp.Format != other.Format || !reflect.DeepEqual(cp.Fields, other.Fields) || cp.TimeFormat != other.TimeFormat || cp.Timezone != other.Timezone {
+		return fmt.Errorf("checkpoint is for a different format, fields or time format")
+	}
+	if cp.Where != other.Where {
+		return fmt.Errorf("checkpoint is for a different --where")
+	}
+	return nil
+}
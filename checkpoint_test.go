@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRapidCheckpointMatches(t *testing.T) {
+	saved := &rapidCheckpoint{
+		Filter:      map[string][]string{"bitmex": {"trade"}},
+		Start:       1000,
+		End:         2000,
+		StartOption: "now-1h",
+		EndOption:   "now",
+		Format:      "json",
+	}
+	tests := []struct {
+		name  string
+		other rapidCheckpoint
+		ok    bool
+	}{
+		{"relative range resolved later", rapidCheckpoint{Filter: saved.Filter, Start: 5000, End: 6000, StartOption: "now-1h", EndOption: "now", Format: "json"}, true},
+		{"different start", rapidCheckpoint{Filter: saved.Filter, Start: 1000, End: 2000, StartOption: "now-2h", EndOption: "now", Format: "json"}, false},
+		{"duration instead of end", rapidCheckpoint{Filter: saved.Filter, Start: 1000, End: 2000, StartOption: "now-1h", DurationOption: "1h", Format: "json"}, false},
+		{"different filter", rapidCheckpoint{Filter: map[string][]string{"bitmex": {"orderBookL2"}}, StartOption: "now-1h", EndOption: "now", Format: "json"}, false},
+		{"different format", rapidCheckpoint{Filter: saved.Filter, StartOption: "now-1h", EndOption: "now", Format: "csv"}, false},
+	}
+	for _, test := range tests {
+		if err := saved.matches(&test.other); (err == nil) != test.ok {
+			t.Errorf("%s: matches() = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+func TestRapidCheckpointMatchesOlder(t *testing.T) {
+	// Written by versions which did not record options
+	saved := &rapidCheckpoint{Filter: map[string][]string{"bitmex": {"trade"}}, Start: 1000, End: 2000, Format: "json"}
+	same := &rapidCheckpoint{Filter: saved.Filter, Start: 1000, End: 2000, StartOption: "1000", EndOption: "2000", Format: "json"}
+	if err := saved.matches(same); err != nil {
+		t.Errorf("matches() = %v for the same range", err)
+	}
+	moved := &rapidCheckpoint{Filter: saved.Filter, Start: 1000, End: 3000, StartOption: "1000", EndOption: "3000", Format: "json"}
+	if err := saved.matches(moved); err == nil {
+		t.Error("matches() = nil for a different range")
+	}
+}
+
+// readOutputs returns decompressed contents of files under `dir` by the relative path.
+func readOutputs(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	outputs := make(map[string]string)
+	serr := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, serr := ioutil.ReadFile(path)
+		if serr != nil {
+			return serr
+		}
+		if strings.HasSuffix(path, ".gz") {
+			gr, serr := gzip.NewReader(bytes.NewReader(data))
+			if serr != nil {
+				return fmt.Errorf("%s: %v", path, serr)
+			}
+			if data, serr = ioutil.ReadAll(gr); serr != nil {
+				return fmt.Errorf("%s: %v", path, serr)
+			}
+		}
+		rel, serr := filepath.Rel(dir, path)
+		if serr != nil {
+			return serr
+		}
+		outputs[rel] = string(data)
+		return nil
+	})
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return outputs
+}
+
+// TestRapidResumeAfterCrash checks that lines written after the checkpoint by a killed run are neither duplicated nor left broken.
+func TestRapidResumeAfterCrash(t *testing.T) {
+	s, dir := startMockServer(t)
+	args := []string{
+		"--filter", `{"bitmex":["trade"],"bitflyer":["lightning_executions_FX_BTC_JPY"]}`, "--start", mockStart, "--end", mockEnd,
+		"--no-cache", "--retry-wait", "1ms", "--paralell", "1",
+	}
+	for _, output := range []string{"output.json", "output.json.gz", "{exchange}/{channel}.json.gz"} {
+		refDir := filepath.Join(dir, "ref", strings.Replace(output, "/", "_", -1))
+		outDir := filepath.Join(dir, "out", strings.Replace(output, "/", "_", -1))
+		checkpointPath := filepath.Join(dir, "checkpoint.json")
+		for _, d := range []string{refDir, outDir} {
+			if serr := os.MkdirAll(d, 0755); serr != nil {
+				t.Fatal(serr)
+			}
+		}
+		if serr := subCmdRapid(append(args, "--output", filepath.Join(refDir, output))); serr != nil {
+			t.Fatal(serr)
+		}
+		want := readOutputs(t, refDir)
+
+		// Stopped after some minutes are requested
+		s.quota = 10
+		s.requests = 0
+		serr := subCmdRapid(append(args, "--output", filepath.Join(outDir, output), "--checkpoint", checkpointPath, "--min-quota", "4"))
+		s.quota = 0
+		if !errors.Is(serr, errQuotaExhausted) {
+			t.Fatalf("%s: the first run returned %v, want to be stopped", output, serr)
+		}
+		saved, serr := loadRapidCheckpoint(checkpointPath)
+		if serr != nil {
+			t.Fatal(serr)
+		}
+		if len(saved.Offsets) == 0 {
+			t.Fatalf("%s: checkpoint records no output", output)
+		}
+		// Killed in the middle of the next minute, leaving a broken line or frame
+		for path := range saved.Offsets {
+			f, serr := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			if serr != nil {
+				t.Fatal(serr)
+			}
+			f.Write([]byte("{\"line_channel\":\"tr\x1f\x8b\x08"))
+			f.Close()
+		}
+		if serr := subCmdRapid(append(args, "--output", filepath.Join(outDir, output), "--checkpoint", checkpointPath, "--resume")); serr != nil {
+			t.Fatalf("%s: %v", output, serr)
+		}
+		got := readOutputs(t, outDir)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: resumed output\n%v\nwant\n%v", output, got, want)
+		}
+		os.Remove(checkpointPath)
+	}
+}
+
+func TestRapidResumeStdout(t *testing.T) {
+	serr := subCmdRapid([]string{"--exchange", "bitmex", "--channel", "trade", "--start", mockStart, "--end", mockEnd, "--checkpoint", "checkpoint.json", "--resume"})
+	if serr == nil {
+		t.Error("resumed to stdout")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/exchangedataset/exd-cli/format"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+	compressionLZ4  = "lz4"
+	// Chunks are split into blocks at least this size to be compressed in parallel
+	compressMinBlockSize = 1024 * 1024
+)
+
+// Compressions detected from the extension of the output
+var compressionExtensions = map[string]string{
+	".gz":   compressionGzip,
+	".gzip": compressionGzip,
+	".zst":  compressionZstd,
+	".zstd": compressionZstd,
+	".lz4":  compressionLZ4,
+}
+
+// compressFunc compresses `p` into a complete frame and writes it to `dst`.
+// Frames can be concatenated and they are decompressed as one stream.
+type compressFunc func(dst *bytes.Buffer, p []byte) error
+
+func compressGzip(dst *bytes.Buffer, p []byte) error {
+	w := gzip.NewWriter(dst)
+	if _, serr := w.Write(p); serr != nil {
+		return serr
+	}
+	return w.Close()
+}
+
+// Encoder shared by routines, EncodeAll can be called concurrently
+var zstdEncoder struct {
+	once sync.Once
+	enc  *zstd.Encoder
+	err  error
+}
+
+func compressZstd(dst *bytes.Buffer, p []byte) error {
+	zstdEncoder.once.Do(func() {
+		zstdEncoder.enc, zstdEncoder.err = zstd.NewWriter(nil)
+	})
+	if zstdEncoder.err != nil {
+		return zstdEncoder.err
+	}
+	dst.Write(zstdEncoder.enc.EncodeAll(p, nil))
+	return nil
+}
+
+func compressLZ4(dst *bytes.Buffer, p []byte) error {
+	w := lz4.NewWriter(dst)
+	if _, serr := w.Write(p); serr != nil {
+		return serr
+	}
+	return w.Close()
+}
+
+// uncompressedSize returns the size of the file at `path` compressed with `compression` after it is decompressed.
+// All frames concatenated in the file are read.
+func uncompressedSize(path string, compression string) (size int64, err error) {
+	f, serr := os.Open(path)
+	if serr != nil {
+		return 0, fmt.Errorf("uncompressedSize: %v", serr)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	switch compression {
+	case compressionGzip:
+		// Readers of gzip and zstd read all frames as one stream
+		gr, serr := gzip.NewReader(br)
+		if serr != nil {
+			return 0, fmt.Errorf("uncompressedSize: %v", serr)
+		}
+		size, err = io.Copy(ioutil.Discard, gr)
+	case compressionZstd:
+		zr, serr := zstd.NewReader(br)
+		if serr != nil {
+			return 0, fmt.Errorf("uncompressedSize: %v", serr)
+		}
+		defer zr.Close()
+		size, err = io.Copy(ioutil.Discard, zr)
+	case compressionLZ4:
+		// The reader of lz4 stops at the end of a frame
+		for {
+			if _, serr := br.Peek(1); serr == io.EOF {
+				break
+			}
+			n, serr := io.Copy(ioutil.Discard, lz4.NewReader(br))
+			size += n
+			if serr != nil {
+				err = serr
+				break
+			}
+		}
+	default:
+		stat, serr := f.Stat()
+		if serr != nil {
+			return 0, fmt.Errorf("uncompressedSize: %v", serr)
+		}
+		return stat.Size(), nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("uncompressedSize: %v", err)
+	}
+	return size, nil
+}
+
+// resolveCompression returns the compression given by the `--compress` option.
+// It is detected from the extension of `path` if `compression` is empty, and empty is returned if it is not detected.
+func resolveCompression(compression string, path string) (string, error) {
+	switch compression {
+	case compressionNone, compressionGzip, compressionZstd, compressionLZ4:
+		return compression, nil
+	case "":
+		if detected, ok := compressionExtensions[strings.ToLower(filepath.Ext(path))]; ok {
+			return detected, nil
+		}
+		return "", nil
+	default:
+		return "", fmt.Errorf("--compress: '%s' not supported", compression)
+	}
+}
+
+// compressFuncOf returns the function to compress with the compression, nil if not compressed.
+func compressFuncOf(compression string) compressFunc {
+	switch compression {
+	case compressionGzip:
+		return compressGzip
+	case compressionZstd:
+		return compressZstd
+	case compressionLZ4:
+		return compressLZ4
+	default:
+		return nil
+	}
+}
+
+// chunkSink is implemented by sinks which take formatted lines of a whole minute at once,
+// without routing them and copying them to their own buffer.
+type chunkSink interface {
+	// WriteChunk writes and flushes lines in `data`, which is not used after it returns.
+	WriteChunk(data []byte) error
+}
+
+// sinkCompress is the sink which compresses chunks of lines and writes them to an io.Writer.
+// A chunk is split into blocks and they are compressed in parallel.
+// Chunks given by WriteChunk are compressed as they are, lines given by Write are buffered until Flush.
+type sinkCompress struct {
+	w io.Writer
+	// Could be nil if the writer should not be closed
+	closer   io.Closer
+	compress compressFunc
+	// Lines written since the last flush
+	pending bytes.Buffer
+	// Buffers compressed blocks are written to, reused in each flush
+	blocks []*bytes.Buffer
+}
+
+func (s *sinkCompress) Route(exchange string, channel string, timestamp int64) error {
+	return nil
+}
+
+func (s *sinkCompress) Write(p []byte) (int, error) {
+	return s.pending.Write(p)
+}
+
+func (s *sinkCompress) Flush() error {
+	if s.pending.Len() == 0 {
+		return nil
+	}
+	if serr := s.compressBlocks(s.pending.Bytes()); serr != nil {
+		return serr
+	}
+	s.pending.Reset()
+	return nil
+}
+
+func (s *sinkCompress) WriteChunk(data []byte) error {
+	// Lines written before such as the header come first
+	if serr := s.Flush(); serr != nil {
+		return serr
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return s.compressBlocks(data)
+}
+
+// compressBlocks splits `data` into blocks, compresses them in parallel and writes them in order.
+func (s *sinkCompress) compressBlocks(data []byte) error {
+	count := len(data) / compressMinBlockSize
+	if count > runtime.NumCPU() {
+		count = runtime.NumCPU()
+	} else if count == 0 {
+		count = 1
+	}
+	for len(s.blocks) < count {
+		s.blocks = append(s.blocks, new(bytes.Buffer))
+	}
+	size := (len(data) + count - 1) / count
+	errs := make([]error, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		start := i * size
+		end := start + size
+		if end > len(data) {
+			end = len(data)
+		}
+		s.blocks[i].Reset()
+		wg.Add(1)
+		go func(i int, block []byte) {
+			defer wg.Done()
+			errs[i] = s.compress(s.blocks[i], block)
+		}(i, data[start:end])
+	}
+	wg.Wait()
+	for i := 0; i < count; i++ {
+		if errs[i] != nil {
+			return fmt.Errorf("compress: %v", errs[i])
+		}
+		if _, serr := s.w.Write(s.blocks[i].Bytes()); serr != nil {
+			return serr
+		}
+	}
+	return nil
+}
+
+func (s *sinkCompress) Sync() error {
+	if serr := s.Flush(); serr != nil {
+		return serr
+	}
+	return syncCloser(s.closer)
+}
+
+func (s *sinkCompress) Close() error {
+	serr := s.Flush()
+	if s.closer == nil {
+		return serr
+	}
+	if cerr := s.closer.Close(); serr == nil {
+		serr = cerr
+	}
+	return serr
+}
+
+func newCompressSink(w io.Writer, closer io.Closer, compress compressFunc) format.Sink {
+	return &sinkCompress{w: w, closer: closer, compress: compress}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestUncompressedSize checks that all frames appended by separate runs are counted.
+func TestUncompressedSize(t *testing.T) {
+	dir, serr := ioutil.TempDir("", "exd-test-*")
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	defer os.RemoveAll(dir)
+	frames := [][]byte{
+		[]byte("header\n"),
+		bytes.Repeat([]byte("{\"price\":11700.5}\n"), 1000),
+		[]byte("last\n"),
+	}
+	var want int64
+	for _, frame := range frames {
+		want += int64(len(frame))
+	}
+	for _, compression := range []string{compressionGzip, compressionZstd, compressionLZ4} {
+		path := filepath.Join(dir, "out."+compression)
+		buf := new(bytes.Buffer)
+		for _, frame := range frames {
+			if serr := compressFuncOf(compression)(buf, frame); serr != nil {
+				t.Fatal(serr)
+			}
+		}
+		if serr := ioutil.WriteFile(path, buf.Bytes(), 0644); serr != nil {
+			t.Fatal(serr)
+		}
+		got, serr := uncompressedSize(path, compression)
+		if serr != nil {
+			t.Errorf("uncompressedSize(%s): %v", compression, serr)
+			continue
+		}
+		if got != want {
+			t.Errorf("uncompressedSize(%s) = %d, want %d", compression, got, want)
+		}
+	}
+}
+
+// TestSinkCompressWriteChunk checks that lines written before a chunk come first.
+func TestSinkCompressWriteChunk(t *testing.T) {
+	out := new(bytes.Buffer)
+	sink := newCompressSink(out, nil, compressGzip)
+	if _, serr := sink.Write([]byte("header\n")); serr != nil {
+		t.Fatal(serr)
+	}
+	chunk := bytes.Repeat([]byte("line\n"), compressMinBlockSize/2)
+	if serr := sink.(chunkSink).WriteChunk(chunk); serr != nil {
+		t.Fatal(serr)
+	}
+	if serr := sink.Close(); serr != nil {
+		t.Fatal(serr)
+	}
+	gr, serr := gzip.NewReader(out)
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	got, serr := ioutil.ReadAll(gr)
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	if want := append([]byte("header\n"), chunk...); !bytes.Equal(got, want) {
+		t.Errorf("decompressed %d bytes are not the header followed by the chunk", len(got))
+	}
+}
@@ -0,0 +1,203 @@
+// Package config loads credentials and other configurable variables of Exchangedataset
+// from named profiles in the config file and environment variables, in the same way as the exd command.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"regexp"
+
+	"github.com/exchangedataset/exdgo"
+)
+
+const (
+	// DirectoryName is the name of the config directory in the home directory
+	DirectoryName      = ".exd"
+	FileName           = "config.json"
+	DefaultProfileName = "default"
+	EnvProfile         = "EXD_PROFILE"
+	EnvAPIKey          = "EXD_API_KEY"
+	EnvCacheLimit      = "EXD_CACHE_LIMIT"
+	EnvBaseURL         = "EXD_BASE_URL"
+)
+
+// ErrNotConfigured is returned from Load if neither the profile nor environment variables are set.
+var ErrNotConfigured = errors.New("not configured")
+
+// envs maps environment variables to the `Config` field they fall back to.
+var envs = map[string]func(c *Config) *string{
+	EnvAPIKey:     func(c *Config) *string { return &c.APIKey },
+	EnvCacheLimit: func(c *Config) *string { return &c.CacheLimit },
+	EnvBaseURL:    func(c *Config) *string { return &c.BaseURL },
+}
+
+var regexProfileName = regexp.MustCompile("^[A-Za-z0-9_\\-]+$")
+
+// Config stores credentials and other configurable variables.
+type Config struct {
+	APIKey string `json:"apikey"`
+	// Size limit of the local cache such as "10GiB", optional
+	CacheLimit string `json:"cache_limit,omitempty"`
+	// URL of the API server to use instead of the official one such as a mock server, optional
+	BaseURL string `json:"base_url,omitempty"`
+}
+
+// File is the content of the config file which holds named profiles.
+type File struct {
+	// APIKey is only present in the config file written by older versions.
+	// It is migrated to the default profile when loaded.
+	APIKey   string             `json:"apikey,omitempty"`
+	Profiles map[string]*Config `json:"profiles"`
+}
+
+func getHomeDirectory() (string, error) {
+	envHome := os.Getenv("HOME")
+	if envHome == "" {
+		// Fallback to get the home directory from system
+		usr, serr := user.Current()
+		if serr != nil {
+			return "", fmt.Errorf("getHomeDirectory: %v", serr)
+		}
+		return usr.HomeDir, nil
+	}
+	return envHome, nil
+}
+
+// Paths returns the path to the config directory and the config file.
+func Paths() (string, string, error) {
+	homeDir, serr := getHomeDirectory()
+	if serr != nil {
+		return "", "", serr
+	}
+	configDirPath := path.Join(homeDir, DirectoryName)
+	return configDirPath, path.Join(configDirPath, FileName), nil
+}
+
+// ResolveProfileName returns the name of the profile to be used.
+// `name` takes precedence over the environment variable, and can be empty.
+func ResolveProfileName(name string) (string, error) {
+	if name == "" {
+		name = os.Getenv(EnvProfile)
+	}
+	if name == "" {
+		return DefaultProfileName, nil
+	}
+	if !regexProfileName.MatchString(name) {
+		return "", fmt.Errorf("invalid profile name '%s'", name)
+	}
+	return name, nil
+}
+
+// LoadFile reads the config file at `configPath`.
+// Returns an empty config file if it does not exist.
+func LoadFile(configPath string) (*File, error) {
+	cf := new(File)
+	data, serr := ioutil.ReadFile(configPath)
+	if os.IsNotExist(serr) {
+		cf.Profiles = make(map[string]*Config)
+		return cf, nil
+	} else if serr != nil {
+		return nil, fmt.Errorf("load: %v", serr)
+	}
+	serr = json.Unmarshal(data, cf)
+	if serr != nil {
+		return nil, fmt.Errorf("load: %v", serr)
+	}
+	if cf.Profiles == nil {
+		cf.Profiles = make(map[string]*Config)
+	}
+	if cf.APIKey != "" {
+		// Migrate the config written by older versions
+		if _, ok := cf.Profiles[DefaultProfileName]; !ok {
+			cf.Profiles[DefaultProfileName] = &Config{APIKey: cf.APIKey}
+		}
+		cf.APIKey = ""
+	}
+	return cf, nil
+}
+
+// SaveFile writes `cf` to `configFilePath`, making the config directory if it does not exist.
+func SaveFile(configDirPath string, configFilePath string, cf *File) (err error) {
+	marshaled, err := json.Marshal(cf)
+	if err != nil {
+		return
+	}
+	var stat os.FileInfo
+	if stat, err = os.Stat(configDirPath); os.IsNotExist(err) {
+		// Make a directory if it does not exist
+		err = os.Mkdir(configDirPath, 0755)
+		if err != nil {
+			return
+		}
+	} else {
+		if err != nil {
+			return
+		}
+		if !stat.IsDir() {
+			return fmt.Errorf("%s is not a directory, please remove it", configDirPath)
+		}
+	}
+	// Create (if not exists) and write to the file
+	return ioutil.WriteFile(configFilePath, marshaled, 0700)
+}
+
+// ApplyEnvs sets fields of `c` which are empty to the values of environment variables.
+// Fields already set are never overridden.
+// Returns true if any of the variables is applied.
+func (c *Config) ApplyEnvs() bool {
+	applied := false
+	for env, field := range envs {
+		if value := os.Getenv(env); value != "" && *field(c) == "" {
+			*field(c) = value
+			applied = true
+		}
+	}
+	return applied
+}
+
+// Load returns the config of the profile, with empty fields set from environment variables.
+// `profile` can be empty to use the profile resolved by ResolveProfileName.
+// The error wraps ErrNotConfigured if neither the profile nor environment variables are set.
+func Load(profile string) (*Config, error) {
+	_, configPath, serr := Paths()
+	if serr != nil {
+		return nil, fmt.Errorf("config Load: %v", serr)
+	}
+	name, serr := ResolveProfileName(profile)
+	if serr != nil {
+		return nil, fmt.Errorf("config Load: %v", serr)
+	}
+	cf, serr := LoadFile(configPath)
+	if serr != nil {
+		return nil, fmt.Errorf("config Load: %v", serr)
+	}
+	c := new(Config)
+	saved, ok := cf.Profiles[name]
+	if ok {
+		*c = *saved
+	}
+	// Environment variables are the fallback for what the profile does not set
+	if !c.ApplyEnvs() && !ok {
+		if len(cf.Profiles) == 0 {
+			return nil, fmt.Errorf("config Load: %w: no profile is set and %s is not set", ErrNotConfigured, EnvAPIKey)
+		}
+		return nil, fmt.Errorf("config Load: %w: profile '%s' is not set", ErrNotConfigured, name)
+	}
+	if c.APIKey == "" {
+		return nil, fmt.Errorf("config Load: API-key is empty for profile '%s'", name)
+	}
+	return c, nil
+}
+
+// ClientParam makes the parameter of exdgo clients from the config.
+// It does not carry BaseURL as exdgo always sends requests to APIURL, use HTTPClient or Transport for it.
+func (c *Config) ClientParam() exdgo.ClientParam {
+	var cp exdgo.ClientParam
+	cp.APIKey = c.APIKey
+	return cp
+}
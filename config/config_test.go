@@ -0,0 +1,87 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// setEnvs sets environment variables until the test ends.
+func setEnvs(t *testing.T, envs map[string]string) {
+	t.Helper()
+	for key, value := range envs {
+		old, ok := os.LookupEnv(key)
+		os.Setenv(key, value)
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		})
+	}
+}
+
+// writeProfiles makes a home directory with the config file of `profiles`.
+func writeProfiles(t *testing.T, profiles map[string]*Config) {
+	t.Helper()
+	home, serr := ioutil.TempDir("", "exd-test-*")
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	t.Cleanup(func() { os.RemoveAll(home) })
+	setEnvs(t, map[string]string{"HOME": home, EnvProfile: "", EnvAPIKey: "", EnvCacheLimit: "", EnvBaseURL: ""})
+	if profiles == nil {
+		return
+	}
+	dir, file, serr := Paths()
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	if serr := SaveFile(dir, file, &File{Profiles: profiles}); serr != nil {
+		t.Fatal(serr)
+	}
+}
+
+func TestLoadEnvFallback(t *testing.T) {
+	writeProfiles(t, map[string]*Config{
+		DefaultProfileName: {APIKey: "default-key"},
+		"ci":               {APIKey: "ci-key", BaseURL: "http://localhost/v1/"},
+	})
+	setEnvs(t, map[string]string{EnvAPIKey: "env-key", EnvBaseURL: "http://env/v1/", EnvCacheLimit: "1GiB"})
+	tests := []struct {
+		profile string
+		want    Config
+	}{
+		{"", Config{APIKey: "default-key", BaseURL: "http://env/v1/", CacheLimit: "1GiB"}},
+		{"ci", Config{APIKey: "ci-key", BaseURL: "http://localhost/v1/", CacheLimit: "1GiB"}},
+		// Not saved, environment variables are used alone
+		{"other", Config{APIKey: "env-key", BaseURL: "http://env/v1/", CacheLimit: "1GiB"}},
+	}
+	for _, test := range tests {
+		c, serr := Load(test.profile)
+		if serr != nil {
+			t.Errorf("Load(%q): %v", test.profile, serr)
+			continue
+		}
+		if *c != test.want {
+			t.Errorf("Load(%q) = %+v, want %+v", test.profile, *c, test.want)
+		}
+	}
+}
+
+func TestLoadNotConfigured(t *testing.T) {
+	writeProfiles(t, nil)
+	if _, serr := Load(""); !errors.Is(serr, ErrNotConfigured) {
+		t.Errorf("Load() = %v, want ErrNotConfigured", serr)
+	}
+	setEnvs(t, map[string]string{EnvAPIKey: "env-key"})
+	c, serr := Load("")
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	if c.APIKey != "env-key" {
+		t.Errorf("APIKey = %s, want env-key", c.APIKey)
+	}
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// APIURL is the URL of the API server exdgo sends requests to.
+const APIURL = "https://api.exchangedataset.cc/v1/"
+
+// baseURLTransport redirects requests for the API server to another server.
+type baseURLTransport struct {
+	base string
+	next http.RoundTripper
+}
+
+func (t *baseURLTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !strings.HasPrefix(req.URL.String(), APIURL) {
+		return t.next.RoundTrip(req)
+	}
+	redirected, serr := url.Parse(t.base + strings.TrimPrefix(req.URL.String(), APIURL))
+	if serr != nil {
+		return nil, serr
+	}
+	// RoundTrip must not modify the request
+	cloned := req.Clone(req.Context())
+	cloned.URL = redirected
+	cloned.Host = redirected.Host
+	return t.next.RoundTrip(cloned)
+}
+
+// Transport returns the transport sending requests for the API server to BaseURL through `next`.
+// `next` is returned as it is if BaseURL is not set, http.DefaultTransport is used if `next` is nil.
+func (c *Config) Transport(next http.RoundTripper) (http.RoundTripper, error) {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	if c.BaseURL == "" {
+		return next, nil
+	}
+	if _, serr := url.Parse(c.BaseURL); serr != nil {
+		return nil, fmt.Errorf("config Transport: %v", serr)
+	}
+	base := c.BaseURL
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return &baseURLTransport{base: base, next: next}, nil
+}
+
+// HTTPClient returns the client sending requests for the API server to BaseURL through `next`.
+// exdgo only sends requests with http.DefaultClient, set its Transport to the one of this client to use BaseURL with exdgo.
+func (c *Config) HTTPClient(next http.RoundTripper) (*http.Client, error) {
+	t, serr := c.Transport(next)
+	if serr != nil {
+		return nil, serr
+	}
+	return &http.Client{Transport: t}, nil
+}
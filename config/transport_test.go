@@ -0,0 +1,58 @@
+package config
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer server.Close()
+	tests := []struct {
+		base string
+		url  string
+		want string
+	}{
+		{server.URL + "/v1/", APIURL + "filter/bitmex/1?channels=trade", "/v1/filter/bitmex/1?channels=trade"},
+		// A slash is added to the end
+		{server.URL + "/api", APIURL + "snapshot/bitmex/1", "/api/snapshot/bitmex/1"},
+		// Requests to other servers are not redirected
+		{"http://127.0.0.1:1/v1/", server.URL + "/other", "/other"},
+	}
+	for _, test := range tests {
+		c := &Config{APIKey: "testkey", BaseURL: test.base}
+		client, serr := c.HTTPClient(nil)
+		if serr != nil {
+			t.Fatal(serr)
+		}
+		res, serr := client.Get(test.url)
+		if serr != nil {
+			t.Errorf("%s with %s: %v", test.url, test.base, serr)
+			continue
+		}
+		body, serr := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if serr != nil {
+			t.Fatal(serr)
+		}
+		if string(body) != test.want {
+			t.Errorf("%s with %s is sent to %s, want %s", test.url, test.base, body, test.want)
+		}
+	}
+}
+
+func TestTransportNoBaseURL(t *testing.T) {
+	c := &Config{APIKey: "testkey"}
+	next := &http.Transport{}
+	transport, serr := c.Transport(next)
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	if transport != next {
+		t.Errorf("Transport() = %v, want the transport given", transport)
+	}
+}
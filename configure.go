@@ -1,69 +1,76 @@
 package main
 
 import (
-	"encoding/json"
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"net/http"
 	"os"
-	"os/user"
-	"path"
+	"sort"
+	"strings"
 
+	"github.com/exchangedataset/exd-cli/config"
 	"github.com/exchangedataset/exdgo"
 )
 
-var config *Config
+// currentConfig is the config loaded by initConfig.
+var currentConfig *config.Config
 
-const (
-	configDirectoryName = ".exd"
-	configFileName      = "config.json"
-)
-
-// Config stores credentials and other configurable variables.
-type Config struct {
-	APIKey string `json:"apikey"`
-}
+// profileName is the name of the profile given by the global flag.
+// Empty if not specified.
+var profileName string
 
-func getHomeDirectory() (string, error) {
-	envHome := os.Getenv("HOME")
-	if envHome == "" {
-		// Fallback to get the home directory from system
-		usr, serr := user.Current()
-		if serr != nil {
-			return "", fmt.Errorf("getHomeDirectory: %v", serr)
-		}
-		return usr.HomeDir, nil
-	}
-	return envHome, nil
+// resolveProfileName returns the name of the profile to be used.
+// The global flag takes precedence over the environment variable.
+func resolveProfileName() (string, error) {
+	return config.ResolveProfileName(profileName)
 }
 
 func initConfig() error {
-	homeDir, serr := getHomeDirectory()
+	name, serr := resolveProfileName()
 	if serr != nil {
 		return fmt.Errorf("initConfig: %v", serr)
 	}
-	configPath := path.Join(homeDir, configDirectoryName, configFileName)
-	if _, serr := os.Stat(configPath); os.IsNotExist(serr) {
-		return fmt.Errorf("initConfig: config has not yet setup. please run '%s configure'", os.Args[0])
+	c, serr := config.Load(name)
+	if errors.Is(serr, config.ErrNotConfigured) {
+		_, configPath, perr := config.Paths()
+		if perr != nil {
+			return fmt.Errorf("initConfig: %v", perr)
+		}
+		cf, perr := config.LoadFile(configPath)
+		if perr != nil {
+			return fmt.Errorf("initConfig: %v", perr)
+		}
+		if len(cf.Profiles) == 0 {
+			return fmt.Errorf("initConfig: config has not yet setup. please run '%s configure' or set %s", os.Args[0], config.EnvAPIKey)
+		}
+		return fmt.Errorf("initConfig: profile '%s' has not yet setup. please run '%s configure --profile %s'", name, os.Args[0], name)
 	} else if serr != nil {
 		return fmt.Errorf("initConfig: %v", serr)
 	}
-	data, serr := ioutil.ReadFile(configPath)
+	currentConfig = c
+	return nil
+}
+
+// installTransport makes exdgo send requests to the API server of the current config through `wrappers`.
+// Each wrapper wraps the transport made by the previous one, the last one receives requests first.
+// exdgo only sends requests with http.DefaultClient, it must not be modified elsewhere.
+func installTransport(wrappers ...func(next http.RoundTripper) http.RoundTripper) error {
+	client, serr := currentConfig.HTTPClient(http.DefaultTransport)
 	if serr != nil {
-		return fmt.Errorf("initConfig: %v", serr)
+		return fmt.Errorf("installTransport: %v", serr)
 	}
-	config = new(Config)
-	serr = json.Unmarshal(data, config)
-	if serr != nil {
-		return fmt.Errorf("initConfig: %v", serr)
+	for _, wrap := range wrappers {
+		client.Transport = wrap(client.Transport)
 	}
+	http.DefaultClient.Transport = client.Transport
 	return nil
 }
 
 func makeClientParam() exdgo.ClientParam {
-	var cp exdgo.ClientParam
-	cp.APIKey = config.APIKey
-	return cp
+	return currentConfig.ClientParam()
 }
 
 func maskAPIKey(apikey string) string {
@@ -74,10 +81,27 @@ func maskAPIKey(apikey string) string {
 }
 
 func subCmdConfigure(args []string) (err error) {
+	if len(args) > 0 {
+		switch args[0] {
+		case "list":
+			return subCmdConfigureList(args[1:])
+		case "remove":
+			return subCmdConfigureRemove(args[1:])
+		}
+	}
 	configureSubCmd := flag.NewFlagSet("configure", flag.ExitOnError)
+	optProfile := configureSubCmd.String("profile", "", "Optional. String. Set the name of the profile to configure. Default is the global profile.")
+	optAPIKey := configureSubCmd.String("api-key", "", "Optional. String. Set the API-key without prompting.")
+	optBaseURL := configureSubCmd.String("base-url", "", "Optional. String. Set the URL of the API server to use instead of the official one, such as a mock server. 'default' resets it.")
+	optFromStdin := configureSubCmd.Bool("from-stdin", false, "Optional. Read the API-key from the first line of stdin without prompting. Default is false.")
 	configureSubCmd.Usage = func() {
 		fmt.Fprintln(configureSubCmd.Output(), "Usage of configure:")
 		fmt.Fprintln(configureSubCmd.Output(), "Configures Exchangedataset credentials used to access the API in interactive way.")
+		fmt.Fprintln(configureSubCmd.Output(), "Use --api-key or --from-stdin to configure without a terminal.")
+		configureSubCmd.PrintDefaults()
+		fmt.Fprintln(configureSubCmd.Output(), "Subcommands of configure:")
+		fmt.Fprintln(configureSubCmd.Output(), "  list\tList configured profiles.")
+		fmt.Fprintln(configureSubCmd.Output(), "  remove\tRemove a profile.")
 	}
 	err = configureSubCmd.Parse(args)
 	if err != nil {
@@ -91,29 +115,66 @@ func subCmdConfigure(args []string) (err error) {
 		}
 	}()
 
+	if *optProfile != "" {
+		profileName = *optProfile
+	}
+	name, err := resolveProfileName()
+	if err != nil {
+		return
+	}
 	// Get the home directory of the current user and setup paths
-	homeDir, err := getHomeDirectory()
+	configDirPath, configFilePath, err := config.Paths()
 	if err != nil {
 		return
 	}
-	configDirPath := path.Join(homeDir, configDirectoryName)
-	configFilePath := path.Join(configDirPath, configFileName)
-
-	var config Config
 	// Load the config file if exist
-	// Ignoring a stat error is intentional
-	if _, err := os.Stat(configFilePath); !os.IsNotExist(err) {
-		data, err := ioutil.ReadFile(configFilePath)
+	cf, err := config.LoadFile(configFilePath)
+	if err != nil {
+		return
+	}
+	profile, ok := cf.Profiles[name]
+	if !ok {
+		profile = new(config.Config)
+	}
+
+	if *optBaseURL == "default" {
+		profile.BaseURL = ""
+	} else if *optBaseURL != "" {
+		profile.BaseURL = *optBaseURL
+	}
+	if *optAPIKey != "" && *optFromStdin {
+		return errors.New("--api-key and --from-stdin can not be set at the same time")
+	}
+	if *optAPIKey != "" {
+		profile.APIKey = *optAPIKey
+	} else if *optFromStdin {
+		profile.APIKey, err = readAPIKeyFromStdin()
 		if err != nil {
-			return fmt.Errorf("load: %v", err)
+			return
 		}
-		err = json.Unmarshal(data, &config)
+	} else {
+		err = promptConfig(name, profile)
 		if err != nil {
-			return fmt.Errorf("load: %v", err)
+			return
 		}
 	}
+	cf.Profiles[name] = profile
+
+	_, err = fmt.Printf("Writing to %s\n", configFilePath)
+	if err != nil {
+		return
+	}
+	err = config.SaveFile(configDirPath, configFilePath, cf)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Println("Config updated")
+	return
+}
 
-	_, err = fmt.Println("Enter your Exchangedataset credentials")
+// promptConfig asks the user to enter values of `profile` in interactive way.
+func promptConfig(name string, profile *config.Config) (err error) {
+	_, err = fmt.Printf("Enter your Exchangedataset credentials for profile '%s'\n", name)
 	if err != nil {
 		return
 	}
@@ -121,44 +182,111 @@ func subCmdConfigure(args []string) (err error) {
 	if err != nil {
 		return
 	}
-	_, err = fmt.Printf("API-key[%s]: ", maskAPIKey(config.APIKey))
+	_, err = fmt.Printf("API-key[%s]: ", maskAPIKey(profile.APIKey))
 	if err != nil {
 		return
 	}
-	_, err = fmt.Scanln(&config.APIKey)
+	_, err = fmt.Scanln(&profile.APIKey)
+	return
+}
+
+// readAPIKeyFromStdin reads the first line of stdin as an API-key.
+func readAPIKeyFromStdin() (string, error) {
+	line, serr := bufio.NewReader(os.Stdin).ReadString('\n')
+	if serr != nil && !(serr == io.EOF && line != "") {
+		return "", fmt.Errorf("stdin: %v", serr)
+	}
+	apikey := strings.TrimSpace(line)
+	if apikey == "" {
+		return "", errors.New("stdin: API-key is empty")
+	}
+	return apikey, nil
+}
+
+func subCmdConfigureList(args []string) (err error) {
+	flg := flag.NewFlagSet("configure list", flag.ExitOnError)
+	flg.Usage = func() {
+		fmt.Fprintln(flg.Output(), "Usage of configure list:")
+		fmt.Fprintln(flg.Output(), "Lists configured profiles. The profile currently selected is marked with '*'.")
+	}
+	err = flg.Parse(args)
 	if err != nil {
 		return
 	}
 
-	_, err = fmt.Printf("Writing to %s\n", configFilePath)
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("configure list: %v", err)
+		}
+	}()
+
+	current, err := resolveProfileName()
 	if err != nil {
 		return
 	}
-	// Marshal entered config
-	marshaled, err := json.Marshal(config)
+	_, configFilePath, err := config.Paths()
 	if err != nil {
 		return
 	}
-	var stat os.FileInfo
-	if stat, err = os.Stat(configDirPath); os.IsNotExist(err) {
-		// Make a directory if it does not exist
-		err = os.Mkdir(configDirPath, 0755)
-		if err != nil {
-			return
+	cf, err := config.LoadFile(configFilePath)
+	if err != nil {
+		return
+	}
+	names := make([]string, 0, len(cf.Profiles))
+	for name := range cf.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		mark := " "
+		if name == current {
+			mark = "*"
 		}
-	} else {
+		_, err = fmt.Printf("%s %s\t%s\n", mark, name, maskAPIKey(cf.Profiles[name].APIKey))
 		if err != nil {
 			return
 		}
-		if !stat.IsDir() {
-			return fmt.Errorf("%s is not a directory, please remove it", configDirPath)
+	}
+	return
+}
+
+func subCmdConfigureRemove(args []string) (err error) {
+	flg := flag.NewFlagSet("configure remove", flag.ExitOnError)
+	flg.Usage = func() {
+		fmt.Fprintln(flg.Output(), "Usage of configure remove PROFILE:")
+		fmt.Fprintln(flg.Output(), "Removes the given profile from the config.")
+	}
+	err = flg.Parse(args)
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("configure remove: %v", err)
 		}
+	}()
+
+	if flg.NArg() != 1 {
+		return errors.New("exactly one profile name must be given")
 	}
-	// Create (if not exists) and write to the file
-	err = ioutil.WriteFile(configFilePath, marshaled, 0700)
+	name := flg.Arg(0)
+	configDirPath, configFilePath, err := config.Paths()
 	if err != nil {
 		return
 	}
-	_, err = fmt.Println("Config updated")
+	cf, err := config.LoadFile(configFilePath)
+	if err != nil {
+		return
+	}
+	if _, ok := cf.Profiles[name]; !ok {
+		return fmt.Errorf("profile '%s' does not exist", name)
+	}
+	delete(cf.Profiles, name)
+	err = config.SaveFile(configDirPath, configFilePath, cf)
+	if err != nil {
+		return
+	}
+	_, err = fmt.Printf("Profile '%s' removed\n", name)
 	return
 }
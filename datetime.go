@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/exchangedataset/exd-cli/datetime"
+)
+
+// makeDatetimeRange makes the range from the `--start`, `--end` and `--duration` options.
+// Either of `--end` or `--duration` must be set, and the range must not be empty.
+func makeDatetimeRange(optStart string, optEnd string, optDuration string) (start time.Time, end time.Time, err error) {
+	// Relative datetimes in both options are relative to the same time
+	now := time.Now()
+	if optStart == "" {
+		err = errors.New("--start must be specified")
+		return
+	}
+	start, err = datetime.Parse(optStart, now)
+	if err != nil {
+		err = fmt.Errorf("--start: %v", err)
+		return
+	}
+	switch {
+	case optEnd != "" && optDuration != "":
+		err = errors.New("--end and --duration can not be set together")
+		return
+	case optEnd != "":
+		end, err = datetime.Parse(optEnd, now)
+		if err != nil {
+			err = fmt.Errorf("--end: %v", err)
+			return
+		}
+	case optDuration != "":
+		duration, serr := datetime.ParseDuration(optDuration)
+		if serr != nil {
+			err = fmt.Errorf("--duration: %v", serr)
+			return
+		}
+		if duration <= 0 {
+			err = errors.New("--duration must be positive")
+			return
+		}
+		end = start.Add(duration)
+	default:
+		err = errors.New("--end or --duration must be specified")
+		return
+	}
+	if !start.Before(end) {
+		err = fmt.Errorf("--start (%s) must be before --end (%s)", start.UTC().Format(time.RFC3339Nano), end.UTC().Format(time.RFC3339Nano))
+	}
+	return
+}
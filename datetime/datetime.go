@@ -0,0 +1,79 @@
+// Package datetime parses datetimes and durations given by users,
+// such as '2020-09-01 12:00', 'now-1h' or '2d'.
+package datetime
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Layouts of datetimes without timezones, which are regarded as UTC
+var datetimeLayouts = []string{
+	"2006-01-02",
+	"2006-01-02 15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02T15:04:05",
+}
+
+// Relative datetime such as 'now-1h' or 'today+9h'
+var relativeDatetimePattern = regexp.MustCompile(`^(now|today|yesterday)\s*(?:([+-])\s*(\S+))?$`)
+
+// ParseDuration parses a duration such as '6h', and also accepts days such as '2d'.
+func ParseDuration(str string) (time.Duration, error) {
+	if days := strings.TrimSuffix(str, "d"); days != str {
+		count, serr := strconv.ParseInt(days, 10, 64)
+		if serr != nil {
+			return 0, fmt.Errorf("invalid duration '%s'", str)
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(str)
+}
+
+// Parse converts the datetime given by a user into time.Time.
+// Unix time in nanoseconds, RFC3339 and datetimes such as '2020-09-01' or '2020-09-01 12:00' in UTC are accepted,
+// as well as 'now', 'today' and 'yesterday' in UTC optionally followed by an offset such as 'now-1h'.
+func Parse(str string, now time.Time) (time.Time, error) {
+	str = strings.TrimSpace(str)
+	unixNanoTime, serr := strconv.ParseInt(str, 10, 64)
+	if serr == nil {
+		return time.Unix(0, unixNanoTime), nil
+	}
+	if rfc3339NanoTime, serr := time.Parse(time.RFC3339Nano, str); serr == nil {
+		return rfc3339NanoTime, nil
+	}
+	for _, layout := range datetimeLayouts {
+		if t, serr := time.Parse(layout, str); serr == nil {
+			return t, nil
+		}
+	}
+	match := relativeDatetimePattern.FindStringSubmatch(strings.ToLower(str))
+	if match == nil {
+		return time.Time{}, fmt.Errorf("datetime Parse: '%s' is not a supported datetime", str)
+	}
+	now = now.UTC()
+	var base time.Time
+	switch match[1] {
+	case "now":
+		base = now
+	case "today":
+		base = now.Truncate(24 * time.Hour)
+	case "yesterday":
+		base = now.Truncate(24 * time.Hour).Add(-24 * time.Hour)
+	}
+	if match[2] == "" {
+		return base, nil
+	}
+	offset, serr := ParseDuration(match[3])
+	if serr != nil {
+		return time.Time{}, fmt.Errorf("datetime Parse: %v", serr)
+	}
+	if match[2] == "-" {
+		offset = -offset
+	}
+	return base.Add(offset), nil
+}
@@ -0,0 +1,88 @@
+package datetime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		str  string
+		want time.Duration
+		err  bool
+	}{
+		{"6h", 6 * time.Hour, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"2d", 48 * time.Hour, false},
+		{"0d", 0, false},
+		{"-1d", -24 * time.Hour, false},
+		{"1.5d", 0, true},
+		{"d", 0, true},
+		{"2days", 0, true},
+		{"", 0, true},
+	}
+	for _, test := range tests {
+		got, err := ParseDuration(test.str)
+		if (err != nil) != test.err {
+			t.Errorf("ParseDuration(%q) error = %v, want error %v", test.str, err, test.err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseDuration(%q) = %v, want %v", test.str, got, test.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	now := time.Date(2020, 9, 1, 12, 34, 56, 789, time.UTC)
+	tests := []struct {
+		str  string
+		want time.Time
+		err  bool
+	}{
+		{"1598918400000000000", time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2020-09-01T00:00:00Z", time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2020-09-01T09:00:00.5+09:00", time.Date(2020, 9, 1, 0, 0, 0, 5e8, time.UTC), false},
+		{"2020-09-01", time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC), false},
+		{"2020-09-01 12:00", time.Date(2020, 9, 1, 12, 0, 0, 0, time.UTC), false},
+		{"2020-09-01 12:00:30", time.Date(2020, 9, 1, 12, 0, 30, 0, time.UTC), false},
+		{"2020-09-01T12:00", time.Date(2020, 9, 1, 12, 0, 0, 0, time.UTC), false},
+		{" 2020-09-01T12:00:30 ", time.Date(2020, 9, 1, 12, 0, 30, 0, time.UTC), false},
+		{"now", now, false},
+		{"NOW", now, false},
+		{"now-1h", now.Add(-time.Hour), false},
+		{"now - 1h", now.Add(-time.Hour), false},
+		{"now+90s", now.Add(90 * time.Second), false},
+		{"today", time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC), false},
+		{"today+9h", time.Date(2020, 9, 1, 9, 0, 0, 0, time.UTC), false},
+		{"yesterday", time.Date(2020, 8, 31, 0, 0, 0, 0, time.UTC), false},
+		{"yesterday-2d", time.Date(2020, 8, 29, 0, 0, 0, 0, time.UTC), false},
+		{"now-", time.Time{}, true},
+		{"now-1x", time.Time{}, true},
+		{"tomorrow", time.Time{}, true},
+		{"2020/09/01", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+	for _, test := range tests {
+		got, err := Parse(test.str, now)
+		if (err != nil) != test.err {
+			t.Errorf("Parse(%q) error = %v, want error %v", test.str, err, test.err)
+			continue
+		}
+		if !got.Equal(test.want) {
+			t.Errorf("Parse(%q) = %v, want %v", test.str, got, test.want)
+		}
+	}
+}
+
+// TestParseNowInOtherZone checks that relative datetimes are in UTC whatever the location of `now` is.
+func TestParseNowInOtherZone(t *testing.T) {
+	now := time.Date(2020, 9, 1, 3, 0, 0, 0, time.FixedZone("JST", 9*60*60))
+	got, err := Parse("today", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2020, 8, 31, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Parse(\"today\") = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/exchangedataset/exd-cli/format"
+)
+
+// The `--fields` option is a list of columns separated by ','. Each column is a field name or an expression,
+// optionally renamed with `AS`, in the same syntax as `--where`.
+//
+//	line_timestamp, price AS p, price * size AS notional, iso(line_timestamp)
+//
+// A column without `AS` is named after its field, or the source of its expression.
+// Columns without spaces, operators or calls are field names as they are, even if they are not valid in expressions
+// such as 'best-bid', '24h_volume' or 'in'.
+
+// outputField is a column given by the `--fields` option.
+type outputField struct {
+	name string
+	// Normalized source of the column such as 'price * size AS notional'
+	spec string
+	// Expression computing the value, nil if the value of the field `name` is output as it is
+	expr whereNode
+}
+
+// Characters which make a column an expression, '-' and '.' are not included as they are common in field names
+const fieldExpressionChars = "()[]'\"`+*/%<>=!~&|"
+
+// splitFields splits the `--fields` option at commas which are not in parentheses, brackets or quotes.
+func splitFields(option string) []string {
+	var columns []string
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i < len(option); i++ {
+		c := option[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '(' || c == '[':
+			depth++
+		case c == ')' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			columns = append(columns, option[start:i])
+			start = i + 1
+		}
+	}
+	return append(columns, option[start:])
+}
+
+// isPlainField reports whether the column is a field name rather than an expression.
+func isPlainField(column string) bool {
+	return column != "" && strings.IndexFunc(column, unicode.IsSpace) < 0 && !strings.ContainsAny(column, fieldExpressionChars)
+}
+
+// parseFieldExpression parses the column which is an expression optionally followed by `AS`.
+func parseFieldExpression(column string) (field outputField, err error) {
+	tokens, serr := tokenizeWhere(column)
+	if serr != nil {
+		return field, serr
+	}
+	p := &whereParser{tokens: tokens}
+	expr, serr := p.parseOr()
+	if serr != nil {
+		return field, serr
+	}
+	src := strings.TrimSpace(column[:p.peek().pos])
+	field = outputField{name: src, spec: src, expr: expr}
+	if plain, ok := expr.(*whereField); ok {
+		field.name = plain.name
+		field.expr = nil
+	}
+	if _, ok := p.accept("as"); ok {
+		alias := p.next()
+		if alias.kind != whereTokenIdent && alias.kind != whereTokenQuotedIdent {
+			return field, fmt.Errorf("position %d: name is expected after AS", alias.pos)
+		}
+		field.name = alias.text
+		field.spec = src + " AS " + alias.text
+		field.expr = expr
+	}
+	if p.peek().kind != whereTokenEOF {
+		return field, p.unexpected()
+	}
+	return field, nil
+}
+
+// parseFields parses the `--fields` option, nil is returned if it is empty.
+func parseFields(option string) ([]outputField, error) {
+	if option == "" {
+		return nil, nil
+	}
+	var fields []outputField
+	names := make(map[string]bool)
+	for _, column := range splitFields(option) {
+		column = strings.TrimSpace(column)
+		var field outputField
+		if isPlainField(column) {
+			field = outputField{name: column, spec: column}
+		} else {
+			var serr error
+			field, serr = parseFieldExpression(column)
+			if serr != nil {
+				return nil, fmt.Errorf("--fields: '%s': %v", column, serr)
+			}
+		}
+		if field.name == "" {
+			return nil, errors.New("--fields: empty column")
+		}
+		if names[field.name] {
+			return nil, fmt.Errorf("--fields: '%s' is duplicated", field.name)
+		}
+		names[field.name] = true
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// outputFieldNames returns names of columns, nil if `fields` is nil.
+func outputFieldNames(fields []outputField) []string {
+	if fields == nil {
+		return nil
+	}
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = field.name
+	}
+	return names
+}
+
+// outputFieldSpecs returns normalized sources of columns, nil if `fields` is nil.
+func outputFieldSpecs(fields []outputField) []string {
+	if fields == nil {
+		return nil
+	}
+	specs := make([]string, len(fields))
+	for i, field := range fields {
+		specs[i] = field.spec
+	}
+	return specs
+}
+
+// computesFields reports whether any of columns is computed or renamed.
+func computesFields(fields []outputField) bool {
+	for _, field := range fields {
+		if field.expr != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// projectFieldDefinitions returns definitions of channels with types of computed columns added,
+// so that typed outputs such as 'parquet' can determine types of them.
+func projectFieldDefinitions(defs format.Definitions, fields []outputField) format.Definitions {
+	if !computesFields(fields) {
+		return defs
+	}
+	projected := make(format.Definitions)
+	for exchange, channels := range defs {
+		for channel, def := range channels {
+			columns := make(map[string]string, len(fields))
+			for _, field := range fields {
+				if field.expr == nil {
+					if typ, ok := def[field.name]; ok {
+						columns[field.name] = typ
+					}
+					continue
+				}
+				columns[field.name] = field.expr.typeOf(def)
+			}
+			projected.Set(exchange, channel, columns)
+		}
+	}
+	return projected
+}
+
+// formatterFields is the formatter which computes columns given by `--fields` and formats them with `form`.
+// Columns of `line_timestamp` are converted into the format given by `--time-format`.
+type formatterFields struct {
+	form format.Formatter
+	// Columns given by `--fields`, nil if all fields are output
+	fields []outputField
+	// Format of timestamps, nil if they are output as they are
+	timeFormat *timeFormat
+	// Names of columns whose values are `line_timestamp`
+	timestamps []string
+}
+
+func (f *formatterFields) WriteHeader(buf *bytes.Buffer) error {
+	return f.form.WriteHeader(buf)
+}
+
+func (f *formatterFields) WriteTo(buf *bytes.Buffer, values map[string]interface{}) error {
+	// Formatters are shared by routines, the map can not be reused
+	var columns map[string]interface{}
+	if f.fields == nil {
+		columns = make(map[string]interface{}, len(values))
+		for key, value := range values {
+			columns[key] = value
+		}
+	} else {
+		columns = make(map[string]interface{}, len(f.fields))
+		for _, field := range f.fields {
+			if field.expr == nil {
+				if value, ok := values[field.name]; ok {
+					columns[field.name] = value
+				}
+				continue
+			}
+			columns[field.name] = field.expr.eval(values)
+		}
+	}
+	if f.timeFormat != nil {
+		for _, name := range f.timestamps {
+			// Values which are not timestamps such as null are left as they are
+			if timestamp, ok := whereNumber(columns[name]).(int64); ok {
+				columns[name] = f.timeFormat.format(timestamp)
+			}
+		}
+	}
+	return f.form.WriteTo(buf, columns)
+}
+
+// newFormatterFields returns the formatter which computes `fields` and converts timestamps with `tf` before formatting them with `form`,
+// which is made with names of `fields`. `form` is returned as it is if nothing is computed or converted.
+func newFormatterFields(form format.Formatter, fields []outputField, tf *timeFormat) format.Formatter {
+	if !computesFields(fields) && tf == nil {
+		return form
+	}
+	f := &formatterFields{form: form, fields: fields, timeFormat: tf}
+	if fields == nil {
+		f.timestamps = []string{format.FieldTimestamp}
+	}
+	for _, field := range fields {
+		if plain, ok := field.expr.(*whereField); field.expr == nil && field.name == format.FieldTimestamp || ok && plain.name == format.FieldTimestamp {
+			f.timestamps = append(f.timestamps, field.name)
+		}
+	}
+	return f
+}
+
+// unwrapFormatter returns the formatter which actually formats lines.
+func unwrapFormatter(form format.Formatter) format.Formatter {
+	if f, ok := form.(*formatterFields); ok {
+		return f.form
+	}
+	return form
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFieldsPlain(t *testing.T) {
+	tests := []struct {
+		option string
+		names  []string
+	}{
+		{"", nil},
+		{"price", []string{"price"}},
+		{"line_timestamp,price,size", []string{"line_timestamp", "price", "size"}},
+		{" price , size ", []string{"price", "size"}},
+		// Names which are not valid in expressions
+		{"best-bid,24h_volume", []string{"best-bid", "24h_volume"}},
+		{"and,or,not,in,as", []string{"and", "or", "not", "in", "as"}},
+		{"bid.price,ask.price", []string{"bid.price", "ask.price"}},
+		{"価格,数量", []string{"価格", "数量"}},
+	}
+	for _, test := range tests {
+		fields, err := parseFields(test.option)
+		if err != nil {
+			t.Errorf("parseFields(%q): %v", test.option, err)
+			continue
+		}
+		if got := outputFieldNames(fields); !reflect.DeepEqual(got, test.names) {
+			t.Errorf("parseFields(%q) names = %q, want %q", test.option, got, test.names)
+		}
+		for _, field := range fields {
+			if field.expr != nil {
+				t.Errorf("parseFields(%q): '%s' is computed", test.option, field.name)
+			}
+		}
+	}
+}
+
+func TestParseFieldsExpressions(t *testing.T) {
+	tests := []struct {
+		option   string
+		names    []string
+		specs    []string
+		computed []bool
+	}{
+		{
+			"price AS p",
+			[]string{"p"},
+			[]string{"price AS p"},
+			[]bool{true},
+		},
+		{
+			"line_timestamp, price*size AS notional, iso(line_timestamp)",
+			[]string{"line_timestamp", "notional", "iso(line_timestamp)"},
+			[]string{"line_timestamp", "price*size AS notional", "iso(line_timestamp)"},
+			[]bool{false, true, true},
+		},
+		{
+			"side in ('Buy', 'Sell') as buy_or_sell, best-bid",
+			[]string{"buy_or_sell", "best-bid"},
+			[]string{"side in ('Buy', 'Sell') AS buy_or_sell", "best-bid"},
+			[]bool{true, false},
+		},
+		{
+			"price - size, `best-bid`",
+			[]string{"price - size", "best-bid"},
+			[]string{"price - size", "`best-bid`"},
+			[]bool{true, false},
+		},
+		{
+			"'a,b' == pair AS ab",
+			[]string{"ab"},
+			[]string{"'a,b' == pair AS ab"},
+			[]bool{true},
+		},
+	}
+	for _, test := range tests {
+		fields, err := parseFields(test.option)
+		if err != nil {
+			t.Errorf("parseFields(%q): %v", test.option, err)
+			continue
+		}
+		if got := outputFieldNames(fields); !reflect.DeepEqual(got, test.names) {
+			t.Errorf("parseFields(%q) names = %q, want %q", test.option, got, test.names)
+		}
+		if got := outputFieldSpecs(fields); !reflect.DeepEqual(got, test.specs) {
+			t.Errorf("parseFields(%q) specs = %q, want %q", test.option, got, test.specs)
+		}
+		for i, field := range fields {
+			if i < len(test.computed) && (field.expr != nil) != test.computed[i] {
+				t.Errorf("parseFields(%q): '%s' computed = %v, want %v", test.option, field.name, field.expr != nil, test.computed[i])
+			}
+		}
+	}
+}
+
+func TestParseFieldsErrors(t *testing.T) {
+	for _, option := range []string{
+		"price,price",
+		"price AS p, size AS p",
+		"price,,size",
+		"price AS",
+		"price AS 1",
+		"price size",
+		"iso(line_timestamp",
+		"unknown(price)",
+	} {
+		if _, err := parseFields(option); err == nil {
+			t.Errorf("parseFields(%q) succeeded", option)
+		}
+	}
+}
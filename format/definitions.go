@@ -0,0 +1,33 @@
+package format
+
+import "sort"
+
+// Definitions holds definitions of messages, map[exchange]map[channel]map[field]type.
+// Types are such as 'int', 'float', 'string', 'timestamp' and 'boolean'.
+type Definitions map[string]map[string]map[string]string
+
+// Set stores the definition, allocating the map for the exchange if needed.
+func (d Definitions) Set(exchange string, channel string, def map[string]string) {
+	if _, ok := d[exchange]; !ok {
+		d[exchange] = make(map[string]map[string]string)
+	}
+	d[exchange][channel] = def
+}
+
+// Keys returns the union of fields of all definitions in the sorted order.
+func (d Definitions) Keys() []string {
+	union := make(map[string]bool)
+	for _, channels := range d {
+		for _, def := range channels {
+			for key := range def {
+				union[key] = true
+			}
+		}
+	}
+	keys := make([]string, 0, len(union))
+	for key := range union {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
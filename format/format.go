@@ -1,4 +1,6 @@
-package main
+// Package format formats lines of Exchangedataset into JSON, CSV or rows of parquet,
+// and defines the interface of sinks formatted lines are written to.
+package format
 
 import (
 	"bytes"
@@ -9,7 +11,16 @@ import (
 	"github.com/exchangedataset/exdgo"
 )
 
+// Names of the special fields added to values of each line
+const (
+	FieldExchange  = "line_exchange"
+	FieldType      = "line_type"
+	FieldTimestamp = "line_timestamp"
+	FieldChannel   = "line_channel"
+)
+
 // Formatter formats lines.
+// WriteTo can be called concurrently, implementations must not modify their state in it.
 type Formatter interface {
 	// WriteHeader write a header to `sb`.
 	WriteHeader(buf *bytes.Buffer) error
@@ -49,6 +60,8 @@ func (f *formatterCSV) WriteTo(buf *bytes.Buffer, values map[string]interface{})
 			case int64:
 				str := strconv.FormatInt(value.(int64), 10)
 				buf.WriteString(str)
+			case bool:
+				buf.WriteString(strconv.FormatBool(value.(bool)))
 			default:
 				return fmt.Errorf("csv WriteTo: type of value not supported: %v", value)
 			}
@@ -62,7 +75,8 @@ func (f *formatterCSV) WriteTo(buf *bytes.Buffer, values map[string]interface{})
 	return nil
 }
 
-func newFormatterCSV(fields []string) Formatter {
+// NewCSV makes new formatter which formats lines into CSV with columns of `fields`.
+func NewCSV(fields []string) Formatter {
 	f := new(formatterCSV)
 	f.fields = fields
 	return f
@@ -93,7 +107,9 @@ func (f *formatterJSON) WriteTo(buf *bytes.Buffer, values map[string]interface{}
 	return nil
 }
 
-func newFormatterJSON(fields []string) Formatter {
+// NewJSON makes new formatter which formats lines into JSON objects.
+// Only `fields` are included, or all fields if it is nil.
+func NewJSON(fields []string) Formatter {
 	f := new(formatterJSON)
 	if fields != nil {
 		f.filter = make(map[string]bool)
@@ -103,3 +119,18 @@ func newFormatterJSON(fields []string) Formatter {
 	}
 	return f
 }
+
+// NewOf makes the formatter for the format name, 'json', 'csv' or 'parquet'.
+// `defs` is used to determine types of columns in 'parquet' format.
+func NewOf(format string, fields []string, defs Definitions) (Formatter, error) {
+	switch format {
+	case "", "json":
+		return NewJSON(fields), nil
+	case "csv":
+		return NewCSV(fields), nil
+	case "parquet":
+		return NewParquet(fields, defs)
+	default:
+		return nil, fmt.Errorf("format '%v' not supported", format)
+	}
+}
@@ -0,0 +1,180 @@
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/exchangedataset/exdgo"
+)
+
+const (
+	parquetTypeInt64     = "INT64"
+	parquetTypeDouble    = "DOUBLE"
+	parquetTypeBoolean   = "BOOLEAN"
+	parquetTypeString    = "BYTE_ARRAY"
+	parquetTypeTimestamp = "TIMESTAMP"
+)
+
+// Types of the special fields
+var parquetLineFieldTypes = map[string]string{
+	FieldExchange:  parquetTypeString,
+	FieldType:      parquetTypeString,
+	FieldTimestamp: parquetTypeTimestamp,
+	FieldChannel:   parquetTypeString,
+}
+
+// parquetTypeOf returns the parquet column type for the type in a channel definition.
+func parquetTypeOf(defType string) string {
+	switch defType {
+	case "int", "duration":
+		return parquetTypeInt64
+	case "timestamp":
+		return parquetTypeTimestamp
+	case "float":
+		return parquetTypeDouble
+	case "boolean", "bool":
+		return parquetTypeBoolean
+	default:
+		return parquetTypeString
+	}
+}
+
+// Parquet formats lines into JSON objects whose values are converted to the type of the columns.
+// Lines can be written to a parquet file by a JSON writer of parquet-go with the schema from Schema.
+type Parquet struct {
+	fields []string
+	// Column types of fields
+	types map[string]string
+}
+
+func (f *Parquet) WriteHeader(buf *bytes.Buffer) error {
+	return nil
+}
+
+func (f *Parquet) WriteTo(buf *bytes.Buffer, values map[string]interface{}) error {
+	row := make(map[string]interface{}, len(f.fields))
+	for _, field := range f.fields {
+		value, ok := values[field]
+		if !ok || value == nil {
+			continue
+		}
+		converted, serr := convertParquetValue(f.types[field], value)
+		if serr != nil {
+			return fmt.Errorf("parquet WriteTo: %s: %v", field, serr)
+		}
+		row[field] = converted
+	}
+	marshaled, serr := json.Marshal(row)
+	if serr != nil {
+		return serr
+	}
+	buf.Write(marshaled)
+	buf.WriteRune('\n')
+	return nil
+}
+
+// convertParquetValue converts `value` into the type which can be marshaled as the column type `typ`.
+func convertParquetValue(typ string, value interface{}) (interface{}, error) {
+	switch typ {
+	case parquetTypeInt64, parquetTypeTimestamp:
+		switch value.(type) {
+		case int64:
+			return value, nil
+		case float64:
+			return int64(value.(float64)), nil
+		case string:
+			return strconv.ParseInt(value.(string), 10, 64)
+		}
+	case parquetTypeDouble:
+		switch value.(type) {
+		case float64:
+			return value, nil
+		case int64:
+			return float64(value.(int64)), nil
+		case string:
+			return strconv.ParseFloat(value.(string), 64)
+		}
+	case parquetTypeBoolean:
+		if b, ok := value.(bool); ok {
+			return b, nil
+		}
+	default:
+		switch value.(type) {
+		case string:
+			return value, nil
+		case exdgo.LineType:
+			return string(value.(exdgo.LineType)), nil
+		}
+		// Other values are stored as JSON strings
+		marshaled, serr := json.Marshal(value)
+		if serr != nil {
+			return nil, serr
+		}
+		return string(marshaled), nil
+	}
+	return nil, fmt.Errorf("value can not be converted to %s: %v", typ, value)
+}
+
+// Schema returns the JSON schema of parquet-go.
+func (f *Parquet) Schema() (string, error) {
+	type schemaField struct {
+		Tag string
+	}
+	root := struct {
+		Tag    string
+		Fields []schemaField
+	}{Tag: "name=parquet_go_root, repetitiontype=REQUIRED"}
+	for _, field := range f.fields {
+		var tag string
+		switch f.types[field] {
+		case parquetTypeTimestamp:
+			tag = "type=INT64, logicaltype=TIMESTAMP, logicaltype.isadjustedtoutc=true, logicaltype.unit=NANOS"
+		case parquetTypeString:
+			tag = "type=BYTE_ARRAY, convertedtype=UTF8"
+		default:
+			tag = "type=" + f.types[field]
+		}
+		root.Fields = append(root.Fields, schemaField{
+			Tag: fmt.Sprintf("name=%s, %s, repetitiontype=OPTIONAL", field, tag),
+		})
+	}
+	marshaled, serr := json.Marshal(root)
+	if serr != nil {
+		return "", serr
+	}
+	return string(marshaled), nil
+}
+
+// NewParquet makes new parquet formatter.
+// Types of columns are determined from definitions of channels.
+func NewParquet(fields []string, defs Definitions) (*Parquet, error) {
+	f := new(Parquet)
+	f.fields = fields
+	f.types = make(map[string]string)
+	for _, field := range fields {
+		if typ, ok := parquetLineFieldTypes[field]; ok {
+			f.types[field] = typ
+			continue
+		}
+		for exchange, channels := range defs {
+			for channel, def := range channels {
+				defType, ok := def[field]
+				if !ok {
+					continue
+				}
+				typ := parquetTypeOf(defType)
+				if prev, ok := f.types[field]; ok && prev != typ {
+					return nil, fmt.Errorf("NewParquet: field '%s' of '%s' '%s' has conflicting type %s", field, exchange, channel, defType)
+				}
+				f.types[field] = typ
+			}
+		}
+		if _, ok := f.types[field]; !ok {
+			// Not in any definitions
+			f.types[field] = parquetTypeString
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,14 @@
+package format
+
+// Sink is the destination of formatted lines.
+type Sink interface {
+	// Route sets the exchange, channel and timestamp of lines written next.
+	// Sinks writing to multiple files use it to determine the file to write to.
+	Route(exchange string, channel string, timestamp int64) error
+	// Write writes formatted lines in `p`, which always ends at the end of a line.
+	Write(p []byte) (int, error)
+	// Flush marks the end of a chunk of lines, such as a minute of data.
+	Flush() error
+	// Close flushes and frees resources the sink is using.
+	Close() error
+}
@@ -4,4 +4,11 @@ go 1.15
 
 require (
 	github.com/exchangedataset/exdgo v0.0.0-20200919092644-93b24978f956
+	github.com/gorilla/websocket v1.4.2
+	github.com/klauspost/compress v1.10.5
+	github.com/mattn/go-sqlite3 v1.14.4
+	github.com/pierrec/lz4/v4 v4.1.2
+	github.com/prometheus/client_golang v1.8.0
+	github.com/xitongsys/parquet-go v1.6.0
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
 )
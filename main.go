@@ -3,60 +3,88 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math/rand"
 	"os"
-	"strconv"
 	"time"
 )
 
-// Converts `Datetime` type parameter to time.Time struct.
-func convertDatetimeParam(str string) (time.Time, error) {
-	unixNanoTime, serr := strconv.ParseInt(str, 10, 64)
-	if serr == nil {
-		return time.Unix(unixNanoTime/int64(time.Nanosecond), unixNanoTime%int64(time.Nanosecond)), nil
-	}
-	rfc3339NanoTime, serr := time.Parse(time.RFC3339Nano, str)
-	if serr != nil {
-		return time.Time{}, fmt.Errorf("convertDatetimeParam: %v", serr)
-	}
-	return rfc3339NanoTime, nil
-}
-
 func main() {
+	// Used for the jitter of retries
+	rand.Seed(time.Now().UnixNano())
+	flag.StringVar(&profileName, "profile", "", "Optional. String. Set the name of the profile to use. Default is the value of EXD_PROFILE or 'default'.")
 	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %v [options] subcommand\n", os.Args[0])
+		flag.PrintDefaults()
 		fmt.Fprintf(flag.CommandLine.Output(), "Subcommands of %v\n", os.Args[0])
 		fmt.Fprintln(flag.CommandLine.Output(), "  configure\tConfigure API-key and other credentials.")
 		fmt.Fprintln(flag.CommandLine.Output(), "  replay\tReplay historical data.")
-		fmt.Fprintln(flag.CommandLine.Output(), "  rapid\tHigh speed dump for a single channel.")
+		fmt.Fprintln(flag.CommandLine.Output(), "  rapid\tHigh speed dump of channels.")
+		fmt.Fprintln(flag.CommandLine.Output(), "  book\tReconstruct order books.")
+		fmt.Fprintln(flag.CommandLine.Output(), "  bars\tAggregate trades into OHLCV bars.")
+		fmt.Fprintln(flag.CommandLine.Output(), "  serve-replay\tStream historical messages over WebSocket.")
+		fmt.Fprintln(flag.CommandLine.Output(), "  cache\tManage the local cache of downloaded data.")
+		fmt.Fprintln(flag.CommandLine.Output(), "  mock-server\tServe a fake API server from fixture files.")
 	}
 	// Shows the usage if help flag is provided
 	flag.Parse()
-	if len(os.Args) < 2 {
+	args := flag.Args()
+	if len(args) < 1 {
 		fmt.Fprintln(os.Stderr, "subcommand is missing")
 		os.Exit(1)
 	}
-	switch os.Args[1] {
+	switch args[0] {
 	case "configure":
 		// Handle configure subcommand
-		err := subCmdConfigure(os.Args[2:])
+		err := subCmdConfigure(args[1:])
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	case "replay":
 		// Handle replay command
-		err := subCmdReplay(os.Args[2:])
+		err := subCmdReplay(args[1:])
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	case "rapid":
-		err := subCmdRapid(os.Args[2:])
+		err := subCmdRapid(args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitCodeOf(err))
+		}
+	case "book":
+		err := subCmdBook(args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "bars":
+		err := subCmdBars(args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "serve-replay":
+		err := subCmdServeReplay(args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "cache":
+		err := subCmdCache(args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "mock-server":
+		err := subCmdMockServer(args[1:])
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	default:
-		fmt.Fprintf(os.Stderr, "unknown subcommand '%v'\n", os.Args[1])
+		fmt.Fprintf(os.Stderr, "unknown subcommand '%v'\n", args[0])
 		os.Exit(1)
 	}
 	os.Exit(0)
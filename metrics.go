@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/exchangedataset/exd-cli/rapid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Description of the metric of slots, whose values are read from rapid.Download
+var rapidSlotsDesc = prometheus.NewDesc("exd_rapid_slots", "Number of download slots in each stage.", []string{"stage"}, nil)
+
+// rapidMetrics exposes the progress of `rapid` as Prometheus metrics.
+type rapidMetrics struct {
+	registry *prometheus.Registry
+	server   *http.Server
+	started  time.Time
+	// Written to the output, accessed atomically
+	bytes int64
+	lines int64
+	// Minutes written to the output
+	minutes prometheus.Counter
+	// Latencies of requests sent through the transport made by instrument
+	latency *prometheus.HistogramVec
+	// Set when the download starts, nil before that
+	rd *rapid.Download
+}
+
+// Describe implements prometheus.Collector for metrics read from rapid.Download.
+func (m *rapidMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rapidSlotsDesc
+}
+
+// Collect implements prometheus.Collector for metrics read from rapid.Download.
+func (m *rapidMetrics) Collect(ch chan<- prometheus.Metric) {
+	counts := m.rd.Stats().Stages
+	for _, stage := range rapid.Stages {
+		ch <- prometheus.MustNewConstMetric(rapidSlotsDesc, prometheus.GaugeValue, float64(counts[stage]), stage.String())
+	}
+}
+
+// watch starts exposing metrics of the download.
+func (m *rapidMetrics) watch(rd *rapid.Download) {
+	m.rd = rd
+	stats := rd.Stats()
+	total := float64(stats.End.Sub(stats.Start) / time.Minute)
+	m.registry.MustRegister(
+		m,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "exd_rapid_minutes",
+			Help: "Number of minutes to download.",
+		}, func() float64 { return total }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "exd_rapid_minutes_downloaded_total",
+			Help: "Number of minutes downloaded and processed, including ones waiting to be written.",
+		}, func() float64 { return float64(rd.Stats().DownloadedMinutes) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "exd_rapid_retries_total",
+			Help: "Number of retried requests.",
+		}, func() float64 { return float64(rd.Stats().Retries) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "exd_rapid_retried_minutes_total",
+			Help: "Number of minutes needed at least one retry.",
+		}, func() float64 { return float64(rd.Stats().RetriedMinutes) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "exd_rapid_request_errors_total",
+			Help: "Number of failed requests, whether they are retried or not.",
+		}, func() float64 { return float64(rd.Stats().RequestErrors) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "exd_rapid_parallel",
+			Help: "Number of minutes allowed to be downloaded at the same time.",
+		}, func() float64 { return float64(rd.Stats().Parallel) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "exd_rapid_throttled_requests_total",
+			Help: "Number of requests failed with 429 Too Many Requests.",
+		}, func() float64 { return float64(rd.Stats().Throttled) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "exd_rapid_buffered_bytes",
+			Help: "Number of bytes of formatted lines buffered in the memory.",
+		}, func() float64 { return float64(rd.Stats().Memory) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "exd_rapid_spilled_minutes_total",
+			Help: "Number of minutes spilled to temporary files to keep --max-memory.",
+		}, func() float64 { return float64(rd.Stats().SpilledMinutes) }),
+	)
+}
+
+// written records the data written to the output.
+// `minute` is true if it is the data of a minute downloaded.
+func (m *rapidMetrics) written(bytes int, lines int, minute bool) {
+	atomic.AddInt64(&m.bytes, int64(bytes))
+	atomic.AddInt64(&m.lines, int64(lines))
+	if minute {
+		m.minutes.Inc()
+	}
+}
+
+// Close stops the server.
+func (m *rapidMetrics) Close() error {
+	return m.server.Close()
+}
+
+// newRapidMetrics starts the server exposing metrics at `addr` under '/metrics'.
+// Latencies of HTTP requests are observed through the transport made by instrument.
+func newRapidMetrics(addr string) (*rapidMetrics, error) {
+	m := new(rapidMetrics)
+	m.registry = prometheus.NewRegistry()
+	m.started = time.Now()
+	m.minutes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "exd_rapid_minutes_written_total",
+		Help: "Number of minutes written to the output.",
+	})
+	m.latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "exd_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests to the API server until the response header is received.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"code", "method"})
+	m.registry.MustRegister(
+		m.minutes,
+		m.latency,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "exd_rapid_written_bytes_total",
+			Help: "Number of bytes written to the output before compression.",
+		}, func() float64 { return float64(atomic.LoadInt64(&m.bytes)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "exd_rapid_written_lines_total",
+			Help: "Number of lines written to the output.",
+		}, func() float64 { return float64(atomic.LoadInt64(&m.lines)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "exd_rapid_lines_per_second",
+			Help: "Average number of lines written per second since the start. Use rate() of exd_rapid_written_lines_total for the recent rate.",
+		}, func() float64 { return float64(atomic.LoadInt64(&m.lines)) / time.Since(m.started).Seconds() }),
+	)
+	ln, serr := net.Listen("tcp", addr)
+	if serr != nil {
+		return nil, fmt.Errorf("--metrics-addr: %v", serr)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	m.server = &http.Server{Handler: mux}
+	go func() {
+		if serr := m.server.Serve(ln); serr != nil && serr != http.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "metrics: %v\n", serr)
+		}
+	}()
+	return m, nil
+}
+
+// instrument wraps `next` to observe latencies of requests.
+func (m *rapidMetrics) instrument(next http.RoundTripper) http.RoundTripper {
+	return promhttp.InstrumentRoundTripperDuration(m.latency, next)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/exchangedataset/exd-cli/config"
+)
+
+// Exchange names are used as a part of paths of fixtures
+var regexExchangeName = regexp.MustCompile("^[A-Za-z0-9_\\-]+$")
+
+// mockServer is a fake API server which serves Snapshot and Filter HTTP endpoints from fixture files.
+//
+// Fixtures are placed in a directory for each exchange:
+//
+//	<exchange>/snapshot.tsv  lines of "timestamp\tchannel\tsnapshot", the first line of a channel is its definition
+//	<exchange>/<minute>.tsv  lines in the same format as the response from Filter HTTP endpoint
+//	<exchange>/<minute>.status  "code [times]" to respond with the status code for the first times (always if omitted)
+//
+// Replay is served as it is built upon these endpoints.
+type mockServer struct {
+	dir string
+	// Requests are rejected if it is not empty and the API-key does not match
+	apikey string
+	mutex  sync.Mutex
+	// Number of requests responded with the error status, by fixture path
+	failed map[string]int
+	// Number of requests allowed, requests are not counted if it is zero
+	quota int64
+	// Number of requests received, guarded by the mutex
+	requests int64
+}
+
+func (s *mockServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if s.apikey != "" && req.Header.Get("Authorization") != "Bearer "+s.apikey {
+		s.error(w, http.StatusUnauthorized, "invalid API-key")
+		return
+	}
+	if s.quota > 0 {
+		s.mutex.Lock()
+		s.requests++
+		remaining := s.quota - s.requests
+		s.mutex.Unlock()
+		w.Header().Set(headerRateLimitLimit, strconv.FormatInt(s.quota, 10))
+		if remaining < 0 {
+			w.Header().Set(headerRateLimitRemaining, "0")
+			s.error(w, http.StatusTooManyRequests, "quota exceeded")
+			return
+		}
+		w.Header().Set(headerRateLimitRemaining, strconv.FormatInt(remaining, 10))
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "v1" {
+		s.error(w, http.StatusNotFound, "not found")
+		return
+	}
+	exchange := parts[2]
+	if !regexExchangeName.MatchString(exchange) {
+		s.error(w, http.StatusBadRequest, "invalid exchange")
+		return
+	}
+	channels := make(map[string]bool)
+	for _, channel := range req.URL.Query()["channels"] {
+		channels[channel] = true
+	}
+	var body []byte
+	var serr error
+	switch parts[1] {
+	case "snapshot":
+		body, serr = s.snapshot(exchange, channels)
+	case "filter":
+		var minute int64
+		minute, serr = strconv.ParseInt(parts[3], 10, 64)
+		if serr != nil {
+			s.error(w, http.StatusBadRequest, "invalid minute")
+			return
+		}
+		if code := s.injectedStatus(exchange, minute); code != 0 {
+			s.error(w, code, "injected error")
+			return
+		}
+		body, serr = s.filter(exchange, minute, channels, req.URL.Query())
+	default:
+		s.error(w, http.StatusNotFound, "not found")
+		return
+	}
+	if os.IsNotExist(serr) {
+		s.error(w, http.StatusNotFound, "not found")
+		return
+	} else if serr != nil {
+		s.error(w, http.StatusInternalServerError, serr.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(body)
+}
+
+func (s *mockServer) error(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "{\"error\":%q}", message)
+}
+
+// injectedStatus returns the status code the filter request should fail with, zero if it should not fail.
+func (s *mockServer) injectedStatus(exchange string, minute int64) int {
+	statusPath := filepath.Join(s.dir, exchange, fmt.Sprintf("%d.status", minute))
+	data, serr := ioutil.ReadFile(statusPath)
+	if serr != nil {
+		return 0
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+	code, serr := strconv.Atoi(fields[0])
+	if serr != nil {
+		return http.StatusInternalServerError
+	}
+	if len(fields) < 2 {
+		return code
+	}
+	times, serr := strconv.Atoi(fields[1])
+	if serr != nil {
+		return http.StatusInternalServerError
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failed[statusPath] >= times {
+		return 0
+	}
+	s.failed[statusPath]++
+	return code
+}
+
+// snapshot returns lines of the snapshot fixture for the channels.
+func (s *mockServer) snapshot(exchange string, channels map[string]bool) ([]byte, error) {
+	data, serr := ioutil.ReadFile(filepath.Join(s.dir, exchange, "snapshot.tsv"))
+	if serr != nil {
+		return nil, serr
+	}
+	var body bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		cols := strings.SplitN(scanner.Text(), "\t", 3)
+		if len(cols) != 3 {
+			return nil, errors.New("broken snapshot fixture")
+		}
+		if channels[cols[1]] {
+			body.WriteString(scanner.Text())
+			body.WriteByte('\n')
+		}
+	}
+	return body.Bytes(), scanner.Err()
+}
+
+// filter returns lines of the filter fixture for the channels in the range given by the query.
+func (s *mockServer) filter(exchange string, minute int64, channels map[string]bool, query url.Values) ([]byte, error) {
+	data, serr := ioutil.ReadFile(filepath.Join(s.dir, exchange, fmt.Sprintf("%d.tsv", minute)))
+	if serr != nil {
+		return nil, serr
+	}
+	var start, end int64 = 0, 1<<63 - 1
+	if query.Get("start") != "" {
+		start, serr = strconv.ParseInt(query.Get("start"), 10, 64)
+		if serr != nil {
+			return nil, serr
+		}
+	}
+	if query.Get("end") != "" {
+		end, serr = strconv.ParseInt(query.Get("end"), 10, 64)
+		if serr != nil {
+			return nil, serr
+		}
+	}
+	var body bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		cols := strings.SplitN(scanner.Text(), "\t", 4)
+		if len(cols) < 2 {
+			return nil, errors.New("broken filter fixture")
+		}
+		timestamp, serr := strconv.ParseInt(strings.TrimSpace(cols[1]), 10, 64)
+		if serr != nil {
+			return nil, serr
+		}
+		if timestamp < start || timestamp >= end {
+			continue
+		}
+		// Only lines of message and send types have a channel
+		if (cols[0] == "msg" || cols[0] == "send") && (len(cols) < 3 || !channels[cols[2]]) {
+			continue
+		}
+		body.WriteString(scanner.Text())
+		body.WriteByte('\n')
+	}
+	return body.Bytes(), scanner.Err()
+}
+
+func subCmdMockServer(args []string) (err error) {
+	flg := flag.NewFlagSet("mock-server", flag.ExitOnError)
+	optAddr := flg.String("addr", "127.0.0.1:8080", "Optional. String. Set the address to listen on. Default is '127.0.0.1:8080'.")
+	optFixtures := flg.String("fixtures", "", "String. Set the path to the directory of fixture files.")
+	optAPIKey := flg.String("api-key", "", "Optional. String. Reject requests without this API-key. Default is to accept any.")
+	optQuota := flg.Int64("quota", 0, "Optional. Int. Reject requests with 429 after this number of requests, and return the remaining in X-RateLimit-* headers. Default is no limit.")
+	flg.Usage = func() {
+		fmt.Fprintln(flg.Output(), "Usage of mock-server:")
+		fmt.Fprintln(flg.Output(), "Serves a fake API server from fixture files for testing without accessing the real one.")
+		fmt.Fprintf(flg.Output(), "Set %s to 'http://ADDR/v1/' to make other subcommands use it.\n", config.EnvBaseURL)
+		flg.PrintDefaults()
+	}
+	err = flg.Parse(args)
+	if err != nil {
+		return
+	}
+	if *optFixtures == "" {
+		return errors.New("--fixtures must be set")
+	}
+	if stat, serr := os.Stat(*optFixtures); serr != nil || !stat.IsDir() {
+		return fmt.Errorf("--fixtures: '%s' is not a directory", *optFixtures)
+	}
+	s := &mockServer{
+		dir:    *optFixtures,
+		apikey: *optAPIKey,
+		failed: make(map[string]int),
+		quota:  *optQuota,
+	}
+	fmt.Fprintf(os.Stderr, "Listening on http://%s/v1/\n", *optAddr)
+	err = http.ListenAndServe(*optAddr, s)
+	if err != nil {
+		err = fmt.Errorf("mock-server: %v", err)
+	}
+	return
+}
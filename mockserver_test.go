@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/exchangedataset/exd-cli/config"
+)
+
+const (
+	mockStart = "2020-09-01T00:00:00Z"
+	mockEnd   = "2020-09-01T00:03:00Z"
+)
+
+// startMockServer serves the fixtures in testdata/mock and points the API server to it until the test ends.
+func startMockServer(t *testing.T) (*mockServer, string) {
+	t.Helper()
+	dir, serr := ioutil.TempDir("", "exd-test-*")
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	s := &mockServer{dir: filepath.Join("testdata", "mock"), failed: make(map[string]int)}
+	server := httptest.NewServer(s)
+	env := map[string]string{
+		"HOME":            dir,
+		config.EnvAPIKey:  "testkey",
+		config.EnvBaseURL: server.URL + "/v1/",
+		config.EnvProfile: "",
+	}
+	restore := make(map[string]string)
+	for key, value := range env {
+		restore[key] = os.Getenv(key)
+		os.Setenv(key, value)
+	}
+	// Subcommands install the transport sending requests to the server
+	transport := http.DefaultClient.Transport
+	t.Cleanup(func() {
+		http.DefaultClient.Transport = transport
+		for key, value := range restore {
+			os.Setenv(key, value)
+		}
+		server.Close()
+		os.RemoveAll(dir)
+	})
+	return s, dir
+}
+
+// runMock runs the subcommand with the arguments and returns the output.
+func runMock(t *testing.T, dir string, subCmd func([]string) error, args ...string) string {
+	t.Helper()
+	output := filepath.Join(dir, "output")
+	if serr := subCmd(append(args, "--output", output)); serr != nil {
+		t.Fatal(serr)
+	}
+	data, serr := ioutil.ReadFile(output)
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	return string(data)
+}
+
+func readMockCSV(t *testing.T, data string) [][]string {
+	t.Helper()
+	records, serr := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	if len(records) == 0 {
+		t.Fatal("no header is written")
+	}
+	return records
+}
+
+// checkMockOrder checks that rows are in the order of line_timestamp in the column.
+func checkMockOrder(t *testing.T, records [][]string, column int) {
+	t.Helper()
+	var prev int64
+	for i, record := range records[1:] {
+		ts, serr := strconv.ParseInt(record[column], 10, 64)
+		if serr != nil {
+			t.Fatalf("row %d: %v", i, serr)
+		}
+		if ts < prev {
+			t.Errorf("row %d: line_timestamp %d comes after %d", i, ts, prev)
+		}
+		prev = ts
+	}
+}
+
+func TestMockRapid(t *testing.T) {
+	s, dir := startMockServer(t)
+	out := runMock(t, dir, subCmdRapid,
+		"--filter", `{"bitmex":["trade"]}`, "--start", mockStart, "--end", mockEnd,
+		"--no-cache", "--retry-wait", "1ms")
+	// 26648641.status fails twice, it must be retried
+	if got := s.failed[filepath.Join(s.dir, "bitmex", "26648641.status")]; got != 2 {
+		t.Errorf("the failing minute failed %d times, want 2", got)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 18 {
+		t.Fatalf("%d lines are written, want 18", len(lines))
+	}
+	want := `{"line_channel":"trade","line_exchange":"bitmex","line_timestamp":1598918400000000123,"line_type":"msg","pair":"XBTUSD","price":11700.5,"side":"Buy","size":100,"timestamp":"1598918399999999123"}`
+	if lines[0] != want {
+		t.Errorf("first line = %s, want %s", lines[0], want)
+	}
+	var prev int64
+	for i, line := range lines {
+		var value struct {
+			Channel   string `json:"line_channel"`
+			Timestamp int64  `json:"line_timestamp"`
+		}
+		if serr := json.Unmarshal([]byte(line), &value); serr != nil {
+			t.Fatalf("line %d: %v", i, serr)
+		}
+		if value.Channel != "trade" {
+			t.Errorf("line %d: channel %s is not filtered", i, value.Channel)
+		}
+		if value.Timestamp < prev {
+			t.Errorf("line %d: line_timestamp %d comes after %d", i, value.Timestamp, prev)
+		}
+		prev = value.Timestamp
+	}
+}
+
+func TestMockRapidCSV(t *testing.T) {
+	_, dir := startMockServer(t)
+	out := runMock(t, dir, subCmdRapid,
+		"--filter", `{"bitmex":["trade"],"bitflyer":["lightning_executions_FX_BTC_JPY"]}`, "--start", mockStart, "--end", mockEnd,
+		"--no-cache", "--retry-wait", "1ms", "--format", "csv", "--fields", "line_exchange,line_timestamp,price,size")
+	records := readMockCSV(t, out)
+	want := [][]string{
+		{"line_exchange", "line_timestamp", "price", "size"},
+		{"bitmex", "1598918400000000123", "11700.5000000000", "100"},
+		{"bitflyer", "1598918405000000123", "1230000.0000000000", "0.0100000000"},
+	}
+	if len(records) != 37 {
+		t.Errorf("%d rows are written, want 37", len(records))
+	}
+	for i, row := range want {
+		if i >= len(records) {
+			break
+		}
+		if strings.Join(records[i], ",") != strings.Join(row, ",") {
+			t.Errorf("row %d = %q, want %q", i, records[i], row)
+		}
+	}
+	checkMockOrder(t, records, 1)
+}
+
+// TestMockReplay checks that replay writes the same lines as rapid.
+func TestMockReplay(t *testing.T) {
+	_, dir := startMockServer(t)
+	args := []string{
+		"--filter", `{"bitmex":["trade"],"bitflyer":["lightning_executions_FX_BTC_JPY"]}`, "--start", mockStart, "--end", mockEnd,
+		"--format", "csv", "--fields", "line_exchange,line_channel,line_timestamp,price,side",
+	}
+	// replay does not retry, rapid runs first to consume the injected failures
+	rapid := runMock(t, dir, subCmdRapid, append(args, "--no-cache", "--retry-wait", "1ms")...)
+	replay := runMock(t, dir, subCmdReplay, args...)
+	if replay != rapid {
+		t.Errorf("replay writes\n%s\nrapid writes\n%s", replay, rapid)
+	}
+	records := readMockCSV(t, replay)
+	checkMockOrder(t, records, 2)
+	exchanges := make(map[string]bool)
+	for _, record := range records[1:] {
+		exchanges[record[0]] = true
+	}
+	if !exchanges["bitmex"] || !exchanges["bitflyer"] {
+		t.Errorf("lines of %v are written, want both exchanges", exchanges)
+	}
+}
+
+// TestMockBook checks that the initial book is built from the snapshot in the stream without downloading it again.
+func TestMockBook(t *testing.T) {
+	s, dir := startMockServer(t)
+	s.quota = 1000
+	out := runMock(t, dir, subCmdBook,
+		"--filter", `{"bitmex":["orderBookL2"]}`, "--start", mockStart, "--end", "2020-09-01T00:01:00Z",
+		"--format", "csv", "--depth", "2")
+	// A snapshot and a minute
+	if s.requests != 2 {
+		t.Errorf("%d requests are sent, want 2", s.requests)
+	}
+	records := readMockCSV(t, out)
+	want := "bitmex,orderBookL2,1598918400000000000,XBTUSD,11700.0000000000,1000.0000000000,11700.5000000000,1500.0000000000,11699.5000000000,2000.0000000000,11701.0000000000,500.0000000000"
+	if len(records) < 2 || strings.Join(records[1], ",") != want {
+		t.Errorf("initial book = %q, want %s", records[1:], want)
+	}
+}
+
+// TestMockReplayJSON checks that replay writes line_timestamp in the same JSON type as rapid.
+func TestMockReplayJSON(t *testing.T) {
+	_, dir := startMockServer(t)
+	args := []string{"--filter", `{"bitmex":["trade"]}`, "--start", mockStart, "--end", "2020-09-01T00:01:00Z", "--where", "line_timestamp > 1598918420000000000", "--fields", "line_exchange,line_timestamp,price,side"}
+	rapid := runMock(t, dir, subCmdRapid, append(args, "--no-cache")...)
+	replay := runMock(t, dir, subCmdReplay, args...)
+	if replay != rapid {
+		t.Errorf("replay writes\n%s\nrapid writes\n%s", replay, rapid)
+	}
+	lines := strings.Split(strings.TrimSuffix(replay, "\n"), "\n")
+	if len(lines) != 4 {
+		t.Errorf("%d lines are written, want 4", len(lines))
+	}
+	var value map[string]interface{}
+	if serr := json.Unmarshal([]byte(lines[0]), &value); serr != nil {
+		t.Fatal(serr)
+	}
+	if _, ok := value["line_timestamp"].(float64); !ok {
+		t.Errorf("line_timestamp is %T, want a number", value["line_timestamp"])
+	}
+}
+
+// TestMockRapidMaxMemory checks that minutes are written in order when responses alone exceed --max-memory.
+func TestMockRapidMaxMemory(t *testing.T) {
+	_, dir := startMockServer(t)
+	args := []string{
+		"--filter", `{"bitmex":["trade"],"bitflyer":["lightning_executions_FX_BTC_JPY"]}`, "--start", mockStart, "--end", mockEnd,
+		"--no-cache", "--retry-wait", "1ms", "--paralell", "4",
+	}
+	want := runMock(t, dir, subCmdRapid, args...)
+	got := runMock(t, dir, subCmdRapid, append(args, "--max-memory", "1")...)
+	if got != want {
+		t.Errorf("lines with --max-memory\n%s\nwant\n%s", got, want)
+	}
+}
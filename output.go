@@ -0,0 +1,519 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/exchangedataset/exd-cli/format"
+)
+
+// Variables which can be used in the `--output` template
+const (
+	outputVarExchange = "{exchange}"
+	outputVarChannel  = "{channel}"
+	outputVarDate     = "{date}"
+	outputVarHour     = "{hour}"
+	outputVarMinute   = "{minute}"
+	outputVarIndex    = "{index}"
+	// Replaces {channel} for lines without channels such as start lines, so that they are written to the same files
+	outputChannelNone = "_none"
+)
+
+// sinkRotation is the condition to switch to a new file.
+type sinkRotation struct {
+	// Lines are written to the file for the window of this duration the timestamp belongs to, zero if not rotated by time
+	interval time.Duration
+	// Files are switched before exceeding this size in bytes, zero if not rotated by size
+	size int64
+}
+
+// makeSinkRotation makes sinkRotation from the `--rotate-interval` and `--rotate-size` options.
+func makeSinkRotation(interval time.Duration, size string) (rotation sinkRotation, err error) {
+	if interval < 0 {
+		return rotation, errors.New("--rotate-interval must be positive")
+	}
+	rotation.interval = interval
+	if size != "" {
+		rotation.size, err = parseByteSize(size)
+		if err != nil {
+			return rotation, fmt.Errorf("--rotate-size: %v", err)
+		}
+		if rotation.size <= 0 {
+			return rotation, errors.New("--rotate-size must be positive")
+		}
+	}
+	return
+}
+
+// sinkSyncer is implemented by sinks writing to files, which can commit lines written to the storage.
+type sinkSyncer interface {
+	// Sync flushes and commits lines written so far to the storage.
+	Sync() error
+}
+
+// syncSink commits lines written to the sink to the storage so that they survive a crash.
+// It only flushes the sink if it does not write to files, such as stdout.
+func syncSink(sink format.Sink) error {
+	if s, ok := sink.(sinkSyncer); ok {
+		return s.Sync()
+	}
+	return sink.Flush()
+}
+
+// sinkOffsetter is implemented by sinks which can tell how far their files have been written,
+// so that lines written after a checkpoint can be removed on resume.
+type sinkOffsetter interface {
+	// Offsets returns the size of each file written so far by path.
+	// Lines must have been committed by syncSink before.
+	Offsets() (map[string]int64, error)
+}
+
+// truncateResumed truncates files to the sizes recorded by the checkpoint,
+// removing lines written after the checkpoint was saved, which could end in a broken line or frame.
+func truncateResumed(resumed map[string]int64) error {
+	for path, size := range resumed {
+		if serr := os.Truncate(path, size); serr != nil {
+			return fmt.Errorf("resume: %v", serr)
+		}
+	}
+	return nil
+}
+
+// syncCloser commits the file to the storage if `closer` is a file.
+func syncCloser(closer io.Closer) error {
+	if f, ok := closer.(*os.File); ok {
+		return f.Sync()
+	}
+	return nil
+}
+
+// sinkWriter is the sink which writes lines to an io.Writer as it is.
+type sinkWriter struct {
+	w io.Writer
+	// Could be nil if the writer is not buffered
+	bw *bufio.Writer
+	// Could be nil if the writer should not be closed
+	closer io.Closer
+}
+
+func (s *sinkWriter) Route(exchange string, channel string, timestamp int64) error {
+	return nil
+}
+
+func (s *sinkWriter) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+func (s *sinkWriter) Flush() error {
+	if s.bw == nil {
+		return nil
+	}
+	return s.bw.Flush()
+}
+
+func (s *sinkWriter) Sync() error {
+	if serr := s.Flush(); serr != nil {
+		return serr
+	}
+	return syncCloser(s.closer)
+}
+
+func (s *sinkWriter) Close() error {
+	serr := s.Flush()
+	if s.closer == nil {
+		return serr
+	}
+	if cerr := s.closer.Close(); serr == nil {
+		serr = cerr
+	}
+	return serr
+}
+
+// newStdoutSink returns the sink which writes to stdout.
+func newStdoutSink() format.Sink {
+	return &sinkWriter{w: os.Stdout}
+}
+
+// newFileSink creates or truncates the file at `path` and returns the sink which writes to it.
+// The file is appended instead if `appendFile` is true.
+// Lines are compressed if `compression` is other than empty or 'none'.
+func newFileSink(path string, appendFile bool, compression string) (format.Sink, error) {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendFile {
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, serr := os.OpenFile(path, flag, 0644)
+	if serr != nil {
+		return nil, fmt.Errorf("newFileSink: %v", serr)
+	}
+	if compress := compressFuncOf(compression); compress != nil {
+		return newCompressSink(f, f, compress), nil
+	}
+	// Lines are written one by one when they are routed to multiple files
+	bw := bufio.NewWriter(f)
+	return &sinkWriter{w: bw, bw: bw, closer: f}, nil
+}
+
+// sinkFile is the sink which writes to a single file at `path`.
+type sinkFile struct {
+	format.Sink
+	path string
+}
+
+func (s *sinkFile) Sync() error {
+	return syncSink(s.Sink)
+}
+
+func (s *sinkFile) WriteChunk(data []byte) error {
+	if cs, ok := s.Sink.(chunkSink); ok {
+		return cs.WriteChunk(data)
+	}
+	// Lines are not routed, they go to the same file
+	if _, serr := s.Sink.Write(data); serr != nil {
+		return serr
+	}
+	return s.Sink.Flush()
+}
+
+func (s *sinkFile) Offsets() (map[string]int64, error) {
+	stat, serr := os.Stat(s.path)
+	if serr != nil {
+		return nil, fmt.Errorf("sinkFile: %v", serr)
+	}
+	return map[string]int64{s.path: stat.Size()}, nil
+}
+
+// openSinkFile opens the file at `path` for the formatter and returns the sink and the size of the file.
+// The header is written if the file is empty, it is not included in the size.
+func openSinkFile(path string, appendFile bool, form format.Formatter, compression string) (format.Sink, int64, error) {
+	if pf, ok := unwrapFormatter(form).(*format.Parquet); ok {
+		if appendFile {
+			return nil, 0, errors.New("'parquet' format can not be appended to the existing output")
+		}
+		sink, serr := newParquetSink(path, pf, compression)
+		return sink, 0, serr
+	}
+	sink, serr := newFileSink(path, appendFile, compression)
+	if serr != nil {
+		return nil, 0, serr
+	}
+	var size int64
+	if appendFile {
+		stat, serr := os.Stat(path)
+		if serr != nil {
+			sink.Close()
+			return nil, 0, fmt.Errorf("openSinkFile: %v", serr)
+		}
+		size = stat.Size()
+	}
+	if size == 0 {
+		buf := new(bytes.Buffer)
+		if serr := form.WriteHeader(buf); serr != nil {
+			sink.Close()
+			return nil, 0, serr
+		}
+		if _, serr := sink.Write(buf.Bytes()); serr != nil {
+			sink.Close()
+			return nil, 0, fmt.Errorf("header: %v", serr)
+		}
+	}
+	return sink, size, nil
+}
+
+// sinkTemplateFile is a file a sinkTemplate is writing to.
+type sinkTemplateFile struct {
+	sink format.Sink
+	path string
+	// Path before {index} is replaced, files are rotated by size for each of it
+	base string
+	// Bytes of lines written to the file before compression
+	size int64
+	// Number of exchange and channel pairs currently routed to this file
+	refs int
+}
+
+// sinkTemplate is the sink which writes lines to files whose names are made from a template.
+type sinkTemplate struct {
+	template    string
+	rotation    sinkRotation
+	form        format.Formatter
+	compression string
+	// Open files by path
+	files map[string]*sinkTemplateFile
+	// Sizes of all files opened so far by path, including those recorded by the checkpoint when resuming.
+	// They are appended when opened again, other files are overwritten
+	offsets map[string]int64
+	// Files exchange and channel pairs (joined with tab) are currently routed to
+	routes map[string]*sinkTemplateFile
+	// Indexes of files rotated by size by the path before {index} is replaced
+	indexes map[string]int
+	// The file lines are written to and the route to it
+	current         *sinkTemplateFile
+	currentExchange string
+	currentChannel  string
+	currentTime     int64
+}
+
+// expand returns the path before {index} is replaced for the route.
+func (s *sinkTemplate) expand(exchange string, channel string, timestamp int64) string {
+	if s.rotation.interval > 0 {
+		timestamp -= timestamp % int64(s.rotation.interval)
+	}
+	t := time.Unix(0, timestamp).UTC()
+	if channel == "" {
+		channel = outputChannelNone
+	}
+	return strings.NewReplacer(
+		outputVarExchange, exchange,
+		outputVarChannel, channel,
+		outputVarDate, t.Format("2006-01-02"),
+		outputVarHour, t.Format("15"),
+		outputVarMinute, t.Format("04"),
+	).Replace(s.template)
+}
+
+func (s *sinkTemplate) Route(exchange string, channel string, timestamp int64) error {
+	base := s.expand(exchange, channel, timestamp)
+	path := strings.Replace(base, outputVarIndex, strconv.Itoa(s.indexes[base]), -1)
+	s.currentExchange = exchange
+	s.currentChannel = channel
+	s.currentTime = timestamp
+	key := exchange + "\t" + channel
+	if f, ok := s.routes[key]; ok {
+		if f.path == path {
+			s.current = f
+			return nil
+		}
+		// Moved to the next window
+		if serr := s.release(key); serr != nil {
+			return serr
+		}
+	}
+	f, ok := s.files[path]
+	if !ok {
+		serr := os.MkdirAll(filepath.Dir(path), 0755)
+		if serr != nil {
+			return fmt.Errorf("sinkTemplate: %v", serr)
+		}
+		_, appendFile := s.offsets[path]
+		sink, size, serr := openSinkFile(path, appendFile, s.form, s.compression)
+		if serr != nil {
+			return fmt.Errorf("sinkTemplate: %v", serr)
+		}
+		if s.rotation.size > 0 && size > 0 && compressFuncOf(s.compression) != nil {
+			// --rotate-size is the size before compression
+			size, serr = uncompressedSize(path, s.compression)
+			if serr != nil {
+				sink.Close()
+				return fmt.Errorf("sinkTemplate: %v", serr)
+			}
+		}
+		f = &sinkTemplateFile{sink: sink, path: path, base: base, size: size}
+		s.files[path] = f
+		// The size is updated when the file is closed or Offsets is called
+		if !appendFile {
+			s.offsets[path] = 0
+		}
+	}
+	f.refs++
+	s.routes[key] = f
+	s.current = f
+	return nil
+}
+
+// release removes the route and closes the file if no routes are left.
+func (s *sinkTemplate) release(key string) error {
+	f := s.routes[key]
+	delete(s.routes, key)
+	f.refs--
+	if f.refs > 0 {
+		return nil
+	}
+	delete(s.files, f.path)
+	// Closing does not commit the file, the checkpoint could be saved after lines in it are lost otherwise
+	if serr := syncSink(f.sink); serr != nil {
+		f.sink.Close()
+		return serr
+	}
+	if serr := f.sink.Close(); serr != nil {
+		return serr
+	}
+	return s.updateOffset(f.path)
+}
+
+// updateOffset records the size of the file at `path` on the storage.
+func (s *sinkTemplate) updateOffset(path string) error {
+	stat, serr := os.Stat(path)
+	if serr != nil {
+		return fmt.Errorf("sinkTemplate: %v", serr)
+	}
+	s.offsets[path] = stat.Size()
+	return nil
+}
+
+func (s *sinkTemplate) Write(p []byte) (int, error) {
+	if s.current == nil {
+		return 0, errors.New("sinkTemplate: lines are written without a route")
+	}
+	f := s.current
+	if s.rotation.size > 0 && f.size > 0 && f.size+int64(len(p)) > s.rotation.size {
+		// Switch all routes to this file to the next file
+		s.indexes[f.base]++
+		for key, routed := range s.routes {
+			if routed == f {
+				if serr := s.release(key); serr != nil {
+					return 0, serr
+				}
+			}
+		}
+		if serr := s.Route(s.currentExchange, s.currentChannel, s.currentTime); serr != nil {
+			return 0, serr
+		}
+		f = s.current
+	}
+	n, serr := f.sink.Write(p)
+	f.size += int64(n)
+	return n, serr
+}
+
+func (s *sinkTemplate) Flush() error {
+	for _, f := range s.files {
+		if serr := f.sink.Flush(); serr != nil {
+			return serr
+		}
+	}
+	return nil
+}
+
+func (s *sinkTemplate) Sync() error {
+	for _, f := range s.files {
+		if serr := syncSink(f.sink); serr != nil {
+			return serr
+		}
+	}
+	return nil
+}
+
+func (s *sinkTemplate) Offsets() (map[string]int64, error) {
+	for path := range s.files {
+		if serr := s.updateOffset(path); serr != nil {
+			return nil, serr
+		}
+	}
+	offsets := make(map[string]int64, len(s.offsets))
+	for path, size := range s.offsets {
+		offsets[path] = size
+	}
+	return offsets, nil
+}
+
+func (s *sinkTemplate) Close() error {
+	var err error
+	for path, f := range s.files {
+		if serr := f.sink.Close(); serr != nil && err == nil {
+			err = serr
+		}
+		delete(s.files, path)
+	}
+	return err
+}
+
+// newTemplateSink returns the sink which writes lines to files whose names are made from `template`.
+// Files in `resumed` are appended, see newSink.
+func newTemplateSink(template string, resumed map[string]int64, form format.Formatter, rotation sinkRotation, compression string) (format.Sink, error) {
+	hasTime := strings.Contains(template, outputVarDate) || strings.Contains(template, outputVarHour) || strings.Contains(template, outputVarMinute)
+	if rotation.interval > 0 && !hasTime {
+		return nil, fmt.Errorf("--output must contain %s, %s or %s to rotate by time", outputVarDate, outputVarHour, outputVarMinute)
+	}
+	if rotation.size > 0 && !strings.Contains(template, outputVarIndex) {
+		return nil, fmt.Errorf("--output must contain %s to rotate by size", outputVarIndex)
+	}
+	s := new(sinkTemplate)
+	s.template = template
+	s.rotation = rotation
+	s.form = form
+	s.compression = compression
+	s.files = make(map[string]*sinkTemplateFile)
+	s.routes = make(map[string]*sinkTemplateFile)
+	s.indexes = make(map[string]int)
+	s.offsets = make(map[string]int64, len(resumed))
+	for path, size := range resumed {
+		s.offsets[path] = size
+	}
+	return s, nil
+}
+
+// newSink returns the sink for the `--output` option and the formatter.
+// Lines are written to stdout if `path` is empty.
+// `path` can be a template containing variables such as {exchange} and {date} to write lines to multiple files.
+// The header is written at the beginning of each file.
+// Lines are compressed with `compression`, which is detected from the extension of `path` if it is empty.
+// `resumed` is nil unless resuming from a checkpoint, otherwise it has the sizes of files recorded by the checkpoint.
+// They are truncated to the sizes and appended, and other files are overwritten.
+func newSink(path string, resumed map[string]int64, form format.Formatter, rotation sinkRotation, compression string) (format.Sink, error) {
+	compression, serr := resolveCompression(compression, path)
+	if serr != nil {
+		return nil, serr
+	}
+	if path == "" {
+		if _, ok := unwrapFormatter(form).(*format.Parquet); ok {
+			return nil, errors.New("--output must be set for 'parquet' format")
+		}
+		if rotation != (sinkRotation{}) {
+			return nil, errors.New("--output must be set to rotate files")
+		}
+		if resumed != nil {
+			return nil, errors.New("--output must be set to resume, lines written to stdout can not be removed")
+		}
+		sink := newStdoutSink()
+		if compress := compressFuncOf(compression); compress != nil {
+			sink = newCompressSink(os.Stdout, nil, compress)
+		}
+		buf := new(bytes.Buffer)
+		if serr := form.WriteHeader(buf); serr != nil {
+			return nil, serr
+		}
+		if _, serr := sink.Write(buf.Bytes()); serr != nil {
+			return nil, fmt.Errorf("header: %v", serr)
+		}
+		return sink, nil
+	}
+	if serr := truncateResumed(resumed); serr != nil {
+		return nil, serr
+	}
+	if strings.Contains(path, "{") || rotation != (sinkRotation{}) {
+		return newTemplateSink(path, resumed, form, rotation, compression)
+	}
+	_, appendFile := resumed[path]
+	sink, _, serr := openSinkFile(path, appendFile, form, compression)
+	if serr != nil {
+		return nil, serr
+	}
+	if _, ok := sink.(*sinkParquet); ok {
+		return sink, nil
+	}
+	return &sinkFile{Sink: sink, path: path}, nil
+}
+
+// Prefix of the `--sink` option for SQLite
+const sinkPrefixSQLite = "sqlite:"
+
+// newSinkOf returns the sink given by the `--sink` option such as 'sqlite:PATH'.
+func newSinkOf(option string, appendFile bool, defs format.Definitions) (format.Sink, error) {
+	if strings.HasPrefix(option, sinkPrefixSQLite) {
+		path := strings.TrimPrefix(option, sinkPrefixSQLite)
+		if path == "" {
+			return nil, errors.New("--sink: path to the database must be set")
+		}
+		return newSQLiteSink(path, appendFile, defs)
+	}
+	return nil, fmt.Errorf("--sink: '%s' not supported", option)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/exchangedataset/exd-cli/format"
+)
+
+// TestSinkTemplateNoChannel checks that lines without channels are written to the same file whatever routes come before them.
+func TestSinkTemplateNoChannel(t *testing.T) {
+	dir, serr := ioutil.TempDir("", "exd-test-*")
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	defer os.RemoveAll(dir)
+	sink, serr := newTemplateSink(filepath.Join(dir, "{exchange}", "{channel}_{date}.json"), nil, format.NewJSON(nil), sinkRotation{}, "")
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	// 2020-09-01T00:00:00Z
+	const ts = 1598918400000000000
+	writes := []struct {
+		exchange string
+		channel  string
+		line     string
+	}{
+		{"bitmex", "", "start\n"},
+		{"bitmex", "trade", "trade\n"},
+		{"bitmex", "", "error\n"},
+		{"bitmex", "orderBookL2", "book\n"},
+		{"bitmex", "", "end\n"},
+	}
+	for _, w := range writes {
+		if serr := sink.Route(w.exchange, w.channel, ts); serr != nil {
+			t.Fatal(serr)
+		}
+		if _, serr := sink.Write([]byte(w.line)); serr != nil {
+			t.Fatal(serr)
+		}
+	}
+	if serr := sink.Close(); serr != nil {
+		t.Fatal(serr)
+	}
+	want := map[string]string{
+		"_none_2020-09-01.json":       "start\nerror\nend\n",
+		"trade_2020-09-01.json":       "trade\n",
+		"orderBookL2_2020-09-01.json": "book\n",
+	}
+	files, serr := ioutil.ReadDir(filepath.Join(dir, "bitmex"))
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	if len(files) != len(want) {
+		t.Errorf("%d files are written, want %d", len(files), len(want))
+	}
+	for name, content := range want {
+		got, serr := ioutil.ReadFile(filepath.Join(dir, "bitmex", name))
+		if serr != nil {
+			t.Error(serr)
+			continue
+		}
+		if string(got) != content {
+			t.Errorf("%s = %q, want %q", name, got, content)
+		}
+	}
+}
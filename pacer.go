@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// replayPacer waits so that lines are sent at the pace they were recorded, multiplied by the speed.
+type replayPacer struct {
+	// Lines are sent as fast as possible if it is zero
+	speed float64
+	// Gaps between lines longer than this are shortened to this, zero if not limited
+	maxGap int64
+	// Timestamp of lines and the wall-clock time the pace is based on
+	base    int64
+	started time.Time
+	// Timestamp of the last line
+	last int64
+	// Receives when pause or resume is requested, could be nil
+	toggle <-chan os.Signal
+}
+
+func newReplayPacer(speed float64, maxGap time.Duration, base int64, toggle <-chan os.Signal) *replayPacer {
+	p := new(replayPacer)
+	p.speed = speed
+	p.maxGap = int64(maxGap)
+	p.base = base
+	p.started = time.Now()
+	p.last = base
+	p.toggle = toggle
+	return p
+}
+
+// pause waits until resume is requested, and delays the pace by the duration paused.
+func (p *replayPacer) pause(ctx context.Context) error {
+	fmt.Fprintln(os.Stderr, "Paused, send the signal again to resume")
+	paused := time.Now()
+	select {
+	case <-p.toggle:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.started = p.started.Add(time.Since(paused))
+	fmt.Fprintln(os.Stderr, "Resumed")
+	return nil
+}
+
+// wait waits until the line at `timestamp` should be sent.
+// Lines before the base timestamp, such as snapshots, are sent immediately.
+func (p *replayPacer) wait(ctx context.Context, timestamp int64) error {
+	select {
+	case <-p.toggle:
+		if serr := p.pause(ctx); serr != nil {
+			return serr
+		}
+	default:
+	}
+	if timestamp <= p.last {
+		return nil
+	}
+	if p.maxGap > 0 && timestamp-p.last > p.maxGap {
+		// Skip the quiet period
+		p.base += timestamp - p.last - p.maxGap
+	}
+	p.last = timestamp
+	if p.speed <= 0 {
+		return nil
+	}
+	for {
+		d := time.Until(p.started.Add(time.Duration(float64(timestamp-p.base) / p.speed)))
+		if d <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+			return nil
+		case <-p.toggle:
+			timer.Stop()
+			if serr := p.pause(ctx); serr != nil {
+				return serr
+			}
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
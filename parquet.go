@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/exchangedataset/exd-cli/format"
+	"github.com/xitongsys/parquet-go-source/writerfile"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Number of goroutines parquet-go uses to marshal rows
+const parquetParallelCount = 4
+
+// sinkParquet writes lines formatted by format.Parquet to a parquet file.
+// A row group is made for every chunk.
+type sinkParquet struct {
+	f  *os.File
+	pw *writer.JSONWriter
+	// Number of rows written since the last flush
+	rows int
+}
+
+func (s *sinkParquet) Route(exchange string, channel string, timestamp int64) error {
+	return nil
+}
+
+func (s *sinkParquet) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(p, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		if serr := s.pw.Write(string(line)); serr != nil {
+			return 0, fmt.Errorf("parquet Write: %v", serr)
+		}
+		s.rows++
+	}
+	return len(p), nil
+}
+
+func (s *sinkParquet) Flush() error {
+	if s.rows == 0 {
+		return nil
+	}
+	s.rows = 0
+	if serr := s.pw.Flush(true); serr != nil {
+		return fmt.Errorf("parquet Flush: %v", serr)
+	}
+	return nil
+}
+
+func (s *sinkParquet) Close() error {
+	serr := s.pw.WriteStop()
+	if cerr := s.f.Close(); serr == nil {
+		serr = cerr
+	}
+	if serr != nil {
+		return fmt.Errorf("parquet Close: %v", serr)
+	}
+	return nil
+}
+
+// parquetCompressionCodecOf returns the codec to compress pages with the compression given by the `--compress` option.
+func parquetCompressionCodecOf(compression string) (parquet.CompressionCodec, error) {
+	switch compression {
+	case "":
+		return parquet.CompressionCodec_SNAPPY, nil
+	case compressionNone:
+		return parquet.CompressionCodec_UNCOMPRESSED, nil
+	case compressionGzip:
+		return parquet.CompressionCodec_GZIP, nil
+	case compressionZstd:
+		return parquet.CompressionCodec_ZSTD, nil
+	default:
+		return 0, fmt.Errorf("'%s' compression is not supported for 'parquet' format", compression)
+	}
+}
+
+// newParquetSink creates the parquet file at `path` with the schema of `form`.
+// Pages are compressed with `compression`, or snappy if it is empty.
+func newParquetSink(path string, form *format.Parquet, compression string) (format.Sink, error) {
+	codec, serr := parquetCompressionCodecOf(compression)
+	if serr != nil {
+		return nil, fmt.Errorf("newParquetSink: %v", serr)
+	}
+	schema, serr := form.Schema()
+	if serr != nil {
+		return nil, fmt.Errorf("newParquetSink: %v", serr)
+	}
+	f, serr := os.Create(path)
+	if serr != nil {
+		return nil, fmt.Errorf("newParquetSink: %v", serr)
+	}
+	s := new(sinkParquet)
+	s.f = f
+	s.pw, serr = writer.NewJSONWriter(schema, writerfile.NewWriterFile(f), parquetParallelCount)
+	if serr != nil {
+		f.Close()
+		return nil, fmt.Errorf("newParquetSink: %v", serr)
+	}
+	s.pw.CompressionType = codec
+	return s, nil
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals to pause and resume paced playback
+var pauseSignals = []os.Signal{syscall.SIGUSR1}
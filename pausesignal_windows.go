@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// Pausing by signals is not supported on Windows
+var pauseSignals []os.Signal
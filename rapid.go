@@ -7,394 +7,220 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
-	"sort"
-	"strings"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/exchangedataset/exd-cli/format"
+	"github.com/exchangedataset/exd-cli/rapid"
 	"github.com/exchangedataset/exdgo"
 )
 
-// This is used for showing progress
-type rapidDownloadStage int
+// Upper limit of the number of paralell downloads of `--paralell auto`
+const rapidAutoMaxParalell = 100
 
-const (
-	rapidDownloadStateEmpty = rapidDownloadStage(iota)
-	rapidDownloadStagePreparing
-	rapidDownloadStageDownloading
-	rapidDownloadStageProcessing
-	rapidDownloadStageDone
-	rapidDownloadStageWatingOthers
-	rapidDownloadStageWatingBufferReturn
-)
-
-type rapidDownloadSlot struct {
-	buf   *bytes.Buffer
-	stage rapidDownloadStage
-}
-
-// rapidParalellResult is the data and its metadata or error during process of child worker (download worker) as the result.
-type rapidDownloadResult struct {
-	pos int
-	err error
-}
-
-// rapidDownload downloads filter data from the server in paralell way, and is optimized for this purpose to utilize high speed internet connection
-// and the resource of the host computer.
-type rapidDownload struct {
-	// Formatter used to format the response
-	form Formatter
-	// Definition of the message
-	msgDef map[string]string
-	// exdgo.Client used to call HTTPFilter
-	c *exdgo.Client
-	// This struct will be used to provide a parameter to HTTPFilter many times by modifying the `minute` value
-	fp exdgo.FilterParam
-	// Maximum number of how much routines will work to download data parallelly
-	parallelCount int
-	// Buffer of downloaded data that can not be sent out because the earlier data has not yet been avaiable
-	// Has a size of parallelCount
-	buffer []rapidDownloadSlot
-	// Position in the buffer where data has not yet been available
-	readPos int
-	// Position in the buffer where the result from the next soon-be-lauched download routine will be stored
-	writePos int
-	// Number of routines currently running or waiting for data retrival via a channel
-	running int
-	// Context the manager routine will run on
-	ctx       context.Context
-	cancelCtx context.CancelFunc
-	// Channel to which the manager routine and its download routines will send an error
-	// An error will be send only once and never
-	err chan error
-	// The last error to be observed
-	lastError error
-	// Channel to which the result will be sent from the manager routine
-	out chan *bytes.Buffer
-	// Channel to which the caller will return `bytes.Buffer` from
-	ret chan *bytes.Buffer
-	// Indicates if this is closed or not
-	closed bool
-}
+func subCmdRapid(args []string) (err error) {
+	flg := flag.NewFlagSet("rapid", flag.ExitOnError)
+	optFilter := flg.String("filter", "", "JSON. Set names of target exchanges and its channels to filter-in. Alternative to --exchange and --channel.")
+	optExchange := flg.String("exchange", "", "String. Set the target exchange.")
+	optChannel := flg.String("channel", "", "String. Set the target channel of the target exchange.")
+	optStart := flg.String("start", "", "Datetime. Set a start datetime of the stream. Unix time in nanoseconds, RFC3339, '2020-09-01', '2020-09-01 12:00', 'now', 'today' or 'yesterday' in UTC optionally followed by an offset such as 'now-1h'.")
+	optEnd := flg.String("end", "", "Datetime. Set a end datetime of the stream. Same formats as --start are accepted.")
+	optDuration := flg.String("duration", "", "Optional. Duration. Set the length of the stream instead of --end, such as '6h' or '2d'.")
+	optFormat := flg.String("format", "", "Optinal. String. Set the output format. 'json', 'csv', 'parquet' are supported. Default is 'json'.")
+	optOutput := flg.String("output", "", "Optional. String. Set the path to the file to write output to. {exchange}, {channel}, {date}, {hour}, {minute} and {index} in it are replaced to write to multiple files, {channel} is _none for lines without channels. Required for 'parquet'. Default is stdout.")
+	optRotateInterval := flg.Duration("rotate-interval", 0, "Optional. Duration. Switch files of --output every this duration of the line timestamp, such as 1h or 24h. Default is not to rotate by time.")
+	optRotateSize := flg.String("rotate-size", "", "Optional. String. Switch files of --output before exceeding this size before compression, such as 100MB. --output must contain {index}. Default is not to rotate by size.")
+	optCompress := flg.String("compress", "", "Optional. String. Compress output with 'gzip', 'zstd', 'lz4' or 'none'. Default is detected from the extension of --output such as '.gz'.")
+	optSink := flg.String("sink", "", "Optional. String. Write lines to the sink other than files instead of --output. 'sqlite:PATH' is supported if exd is built with cgo (CGO_ENABLED=1).")
+	optParalell := flg.String("paralell", "50", "Optional. Int or 'auto'. Set how much filter request will be run in paralell. Higher is faster, but limited by the sequential processing and the computational power. 'auto' adjusts it up to 100 from latencies, errors and the speed of writing. Default is 50.")
+	optMaxRPS := flg.Float64("max-rps", 0, "Optional. Float. Limit requests to the API server to this number per second in total of paralell downloads, such as 5 or 0.5. Default is no limit.")
+	optMaxBytesPerSec := flg.String("max-bytes-per-sec", "", "Optional. String. Limit the download speed to this size per second in total of paralell downloads, such as 10MiB. Default is no limit.")
+	optMinQuota := flg.Int64("min-quota", -1, "Optional. Int. Stop the download when the remaining quota of the API plan returned by the server falls to this number. The progress can be resumed with --checkpoint. Default is not to stop.")
+	optMaxMemory := flg.String("max-memory", "", "Optional. String. Limit the memory to buffer downloaded minutes to this size such as 2GiB. New downloads wait above it, and minutes waiting for earlier ones are spilled to temporary files. It is a soft limit, responses are counted once they are received and a minute larger than its share can exceed it. Default is no limit.")
+	optFields := flg.String("fields", "", "String. Optional. List of fields to be included separated by ','. Columns can be renamed or computed such as 'price AS p,price*size AS notional,iso(line_timestamp)'.")
+	optTimeFormat := flg.String("time-format", "", "Optional. String. Set the format of line_timestamp, 'unixns', 'unixms', 'unix', 'rfc3339nano' or a layout of Go such as '2006-01-02 15:04:05.000'. Not supported for 'parquet' and --sink. Default is nanoseconds as it is.")
+	optTimezone := flg.String("timezone", "", "Optional. String. Set the timezone of --time-format such as 'Asia/Tokyo' or 'Local'. Only for 'rfc3339nano' and layouts. Default is 'UTC'.")
+	optWhere := flg.String("where", "", "Optional. String. Output only lines the expression is true for, such as 'price > 10000 and side == \"Buy\"'. Default is all lines.")
+	optRetry := flg.Int("retry", 5, "Optional. Int. Set how many times a failed filter request will be retried if the error is temporary. Default is 5.")
+	optRetryWait := flg.Duration("retry-wait", time.Second, "Optional. Duration. Set the wait before the first retry, doubled on every retry. Default is 1s.")
+	optRetryMaxWait := flg.Duration("retry-max-wait", 30*time.Second, "Optional. Duration. Set the upper limit of the wait before a retry. Default is 30s.")
+	optNoCache := flg.Bool("no-cache", false, "Optional. Do not use the local cache of downloaded minutes. Default is false.")
+	optCheckpoint := flg.String("checkpoint", "", "Optional. String. Set the path to the file where the progress of the output is recorded.")
+	optMetricsAddr := flg.String("metrics-addr", "", "Optional. String. Expose Prometheus metrics of the progress at http://ADDR/metrics, such as ':9090'. Default is not to expose.")
+	optResume := flg.Bool("resume", false, "Optional. Resume the download from the minute recorded in the file given by --checkpoint. Output files are truncated to the sizes recorded and appended, lines written after the checkpoint are removed. Not supported for stdout. Relative datetimes such as now-1h keep the range resolved by the first run. Default is false.")
 
-func (r *rapidDownload) rapidDownload(ctx context.Context, fp exdgo.FilterParam, slot *rapidDownloadSlot, pos int, resultCh chan rapidDownloadResult) {
-	var err error
-	defer func() {
-		if err != nil {
-			resultCh <- rapidDownloadResult{
-				pos: pos,
-				err: err,
-			}
-		}
-	}()
-	slot.stage = rapidDownloadStageDownloading
-	lines, err := r.c.HTTPFilterWithContext(ctx, fp)
+	err = flg.Parse(args)
 	if err != nil {
 		return
 	}
-	slot.stage = rapidDownloadStageProcessing
-	values := make(map[string]interface{})
-	beforeStartLine := false
-	for _, line := range lines {
-		if line.Type == exdgo.LineTypeMessage {
-			if beforeStartLine {
-				// Skip definition
-				continue
-			}
-			err = json.Unmarshal(line.Message, &values)
-			if err != nil {
-				return
-			}
-			for key, typ := range r.msgDef {
-				if val, ok := values[key]; ok && val != nil && typ == "int" {
-					values[key] = int64(val.(float64))
-				}
-			}
-		} else if line.Type == exdgo.LineTypeStart {
-			beforeStartLine = true
-			continue
-		}
-		values[fieldExchange] = line.Exchange
-		values[fieldType] = line.Type
-		if line.Channel != nil {
-			values[fieldChannel] = *line.Channel
+
+	// Load flags/options
+	var filter map[string][]string
+	if *optFilter != "" {
+		if *optExchange != "" || *optChannel != "" {
+			return errors.New("--filter can not be set with --exchange or --channel")
 		}
-		values[fieldTimestamp] = line.Timestamp
-		err = r.form.WriteTo(slot.buf, values)
+		err = json.Unmarshal([]byte(*optFilter), &filter)
 		if err != nil {
-			return
+			return fmt.Errorf("--filter is not in JSON: %v", err)
 		}
-		// This will be optimized by the compiler
-		for key := range values {
-			delete(values, key)
+		if len(filter) == 0 {
+			return errors.New("--filter must have at least one exchange")
 		}
-	}
-	slot.stage = rapidDownloadStageDone
-	resultCh <- rapidDownloadResult{
-		pos: pos,
-	}
-}
-
-// manager is the function intended to be ran as a routine that manages multiple worker routine (download routine)
-// and the waiting buffer where data be stored when the sequentially ealier data are not yet available.
-func (r *rapidDownload) manager() {
-	// This ensures the manager sends an error only once
-	var err error
-	defer func() {
-		if err != nil {
-			r.err <- fmt.Errorf("manager: %v", err)
+		for exchange, channels := range filter {
+			if len(channels) == 0 {
+				return fmt.Errorf("--filter: no channel is set for '%s'", exchange)
+			}
 		}
-		close(r.err)
-	}()
-	// Close out channel first so r.err will be listened
-	defer close(r.out)
-	startMinute := r.fp.Start.Unix() / 60
-	endMinute := (r.fp.End.Unix() - 1) / 60
-	// Channel to which child routines (download routines) will use to send the result
-	results := make(chan rapidDownloadResult)
-	// This defer function will ensure no running goroutines will be left out before this manager routine is stopped
-	defer func() {
-		for r.running > 0 {
-			// Ignore errors
-			<-results
-			r.running--
+	} else {
+		if *optExchange == "" {
+			return errors.New("--exchange or --filter must be set")
 		}
-	}()
-	// Cancel this context to stop all child routines
-	ctx, cancel := context.WithCancel(r.ctx)
-	defer cancel()
-
-	// Initialize the waiting buffer
-	r.buffer = make([]rapidDownloadSlot, r.parallelCount)
-	// Initialize the buffer slots and start running download routines
-	for ; startMinute+int64(r.writePos) <= endMinute && r.running < r.parallelCount; r.writePos++ {
-		// Allocate memory for bytes buffer
-		// This bytes buffer will be used to return the result from a download routine
-		// It is also be reused for another routine throughout the lifetime of this manager routine
-		bufSlice := make([]byte, 0, 10*1024*1024)
-		buf := bytes.NewBuffer(bufSlice)
-		slot := &r.buffer[r.writePos]
-		// Set buffer slot
-		*slot = rapidDownloadSlot{
-			buf:   buf,
-			stage: rapidDownloadStagePreparing,
-		}
-		r.fp.Minute = time.Unix((startMinute+int64(r.writePos))*60, 0)
-		go r.rapidDownload(ctx, r.fp, slot, r.writePos, results)
-		r.running++
-	}
-	// Fetch result from download routines as well as saving them for sending out later
-	// Launch new routine when the buffer slot became empty and futher fetching is needed
-	for {
-		select {
-		case result := <-results:
-			r.running--
-			if result.err != nil {
-				// A routine returned error
-				err = fmt.Errorf("download routine, futher errors are ignored: %v", result.err)
-				return
-			}
-			slot := &r.buffer[result.pos%r.parallelCount]
-			if slot.stage != rapidDownloadStageDone {
-				err = errors.New("received job done, but the slot are not in the done stage")
-				return
-			}
-			slot.stage = rapidDownloadStageWatingOthers
-			// Send out data in the buffer
-			for ; ; r.readPos++ {
-				slot := &r.buffer[r.readPos%r.parallelCount]
-				if slot.stage != rapidDownloadStageWatingOthers {
-					// This slot is not ready
-					break
-				}
-				// Send
-				select {
-				case r.out <- slot.buf:
-				case <-r.ctx.Done():
-					// Context cancelled
-					err = r.ctx.Err()
-					return
-				}
-				slot.stage = rapidDownloadStageWatingBufferReturn
-				// Wait for the buffer to be returned
-				select {
-				case buf := <-r.ret:
-					// Do not forget to reset buffer
-					buf.Reset()
-					slot.buf = buf
-				case <-r.ctx.Done():
-					// Context cancelled
-					err = r.ctx.Err()
-					return
-				}
-				// Should it launch a new worker routine?
-				if startMinute+int64(r.writePos) <= endMinute {
-					// Run new routine to fetch the next
-					slot.stage = rapidDownloadStagePreparing
-					r.fp.Minute = time.Unix((startMinute+int64(r.writePos))*60, 0)
-					go r.rapidDownload(ctx, r.fp, slot, r.writePos, results)
-					r.running++
-					r.writePos++
-				} else {
-					// Nothing to do, mark this slot as empty
-					slot.buf = nil
-					slot.stage = rapidDownloadStateEmpty
-				}
-			}
-			// Did we reached the end?
-			if r.readPos == r.writePos && r.running == 0 {
-				return
-			}
-		case <-r.ctx.Done():
-			// Context cancelled
-			err = r.ctx.Err()
-			return
+		if *optChannel == "" {
+			return errors.New("--channel must be set")
 		}
+		filter = map[string][]string{*optExchange: {*optChannel}}
 	}
-}
-
-func (r *rapidDownload) Get() (*bytes.Buffer, bool, error) {
-	if r.closed {
-		// If this has already been closed, return the last error
-		return nil, false, r.lastError
-	}
-	select {
-	case buf, ok := <-r.out:
-		return buf, ok, nil
-	case err, ok := <-r.err:
-		if !ok {
-			// r.out is also closed
-			return nil, false, nil
-		}
-		r.lastError = fmt.Errorf("rapidDownload Get: %v", err)
-		return nil, false, r.lastError
+	start, end, err := makeDatetimeRange(*optStart, *optEnd, *optDuration)
+	if err != nil {
+		return
 	}
-}
-
-func (r *rapidDownload) ReturnBuffer(buf *bytes.Buffer) error {
-	if r.closed {
-		// If this has already been closed, return the last error
-		return r.lastError
-	}
-	select {
-	case r.ret <- buf:
-	case err, ok := <-r.err:
-		if !ok {
-			// The manager routine is dead
-			return nil
+	fields, err := parseFields(*optFields)
+	if err != nil {
+		return
+	}
+	var where *whereExpr
+	if *optWhere != "" {
+		where, err = parseWhere(*optWhere)
+		if err != nil {
+			return
 		}
-		r.lastError = fmt.Errorf("rapidDownload ReturnBuffer: %v", err)
-		return r.lastError
 	}
-	return nil
-}
-func (r *rapidDownload) Close() error {
-	if r.closed {
-		// If this has already been closed, return the last error
-		return r.lastError
-	}
-	// This stops the manager routine and its childs
-	r.cancelCtx()
-	if err, ok := <-r.err; ok {
-		r.lastError = fmt.Errorf("rapidDownload Close: %v", err)
-		return r.lastError
-	}
-	close(r.ret)
-	// Mark this as closed
-	r.closed = true
-	return nil
-}
-
-// newRapidDownload makes new rapidDownload and spawns a manager routine.
-func newRapidDownload(ctx context.Context, c *exdgo.Client, parallelCount int, exchange string, channel string, start time.Time, end time.Time, msgDef map[string]string, form Formatter) (r *rapidDownload) {
-	r = new(rapidDownload)
-	r.ctx, r.cancelCtx = context.WithCancel(ctx)
-	r.c = c
-	r.parallelCount = parallelCount
-	format := "json"
-	r.fp = exdgo.FilterParam{
-		Exchange: exchange,
-		Channels: []string{channel},
-		Start:    &start,
-		End:      &end,
-		Format:   &format,
-	}
-	r.msgDef = msgDef
-	r.form = form
-	r.err = make(chan error)
-	r.out = make(chan *bytes.Buffer)
-	r.ret = make(chan *bytes.Buffer)
-	go r.manager()
-	return
-}
-
-func sortDefinitionKeys(def map[string]string) []string {
-	keys := make([]string, len(def))
-	i := 0
-	for key := range def {
-		keys[i] = key
-		i++
-	}
-	sort.Strings(keys)
-	return keys
-}
-
-func subCmdRapid(args []string) (err error) {
-	flg := flag.NewFlagSet("rapid", flag.ExitOnError)
-	optExchange := flg.String("exchange", "", "String. Set the target exchange.")
-	optChannel := flg.String("channel", "", "String. Set the target channel of the target exchange.")
-	optStart := flg.String("start", "", "Datetime. Set a start datetime of the stream.")
-	optEnd := flg.String("end", "", "Datetime. Set a end datetime of the stream.")
-	optFormat := flg.String("format", "", "Optinal. String. Set the output format. 'json', 'csv' are supported. Default is 'json'.")
-	optParalell := flg.Int("paralell", 50, "Optional. Int. Set how much filter request will be run in paralell. Higher is faster, but limited by the sequential processing and the computational power. Default is 50.")
-	optFields := flg.String("fields", "", "String. Optional. List of fields to be included separated by ','.")
-
-	err = flg.Parse(args)
+	formatName := *optFormat
+	var createFormatter func([]string) format.Formatter
+	switch *optFormat {
+	case "":
+		formatName = "json"
+		createFormatter = format.NewJSON
+	case "json":
+		createFormatter = format.NewJSON
+	case "csv":
+		createFormatter = format.NewCSV
+	case "parquet":
+		// Parquet formatter needs definitions, it is created later
+	default:
+		return fmt.Errorf("--format: '%v' not supported", *optFormat)
+	}
+	timeFormat, err := makeTimeFormat(*optTimeFormat, *optTimezone)
 	if err != nil {
 		return
 	}
-
-	// Load flags/options
-	if *optExchange == "" {
-		return errors.New("--exchange must be set")
+	if timeFormat != nil && (formatName == "parquet" || *optSink != "") {
+		// Typed outputs have their own types for timestamps
+		return errors.New("--time-format can not be set for 'parquet' format or --sink")
 	}
-	exchange := *optExchange
-	if *optChannel == "" {
-		return errors.New("--channel must be set")
+	if *optSink != "" {
+		if *optOutput != "" || *optCompress != "" || *optRotateInterval != 0 || *optRotateSize != "" {
+			return errors.New("--output, --compress and --rotate-* can not be set with --sink")
+		}
+		if formatName != "json" {
+			return errors.New("--format can not be set with --sink")
+		}
 	}
-	channel := *optChannel
-	if *optStart == "" {
-		return errors.New("--start must be set")
+	paralellCount := rapidAutoMaxParalell
+	adaptive := *optParalell == "auto"
+	if !adaptive {
+		paralellCount, err = strconv.Atoi(*optParalell)
+		if err != nil || paralellCount <= 0 {
+			return errors.New("--paralell must be a positive integer or 'auto'")
+		}
 	}
-	start, serr := convertDatetimeParam(*optStart)
-	if serr != nil {
-		err = fmt.Errorf("--start: %v", serr)
-		return
+	if *optMaxRPS < 0 {
+		return errors.New("--max-rps must not be negative")
 	}
-	if *optEnd == "" {
-		return errors.New("--end must be set")
+	var maxBytesPerSec int64
+	if *optMaxBytesPerSec != "" {
+		maxBytesPerSec, err = parseByteSize(*optMaxBytesPerSec)
+		if err != nil {
+			return fmt.Errorf("--max-bytes-per-sec: %v", err)
+		}
 	}
-	end, serr := convertDatetimeParam(*optEnd)
-	if serr != nil {
-		err = fmt.Errorf("--end: %v", end)
-		return
+	var maxMemory int64
+	if *optMaxMemory != "" {
+		maxMemory, err = parseByteSize(*optMaxMemory)
+		if err != nil {
+			return fmt.Errorf("--max-memory: %v", err)
+		}
 	}
-	var fields []string
-	if *optFields != "" {
-		fields = strings.Split(*optFields, ",")
+	if *optRetry < 0 {
+		return errors.New("--retry must not be negative")
+	}
+	retry := rapid.RetryPolicy{
+		MaxRetries: *optRetry,
+		BaseWait:   *optRetryWait,
+		MaxWait:    *optRetryMaxWait,
+	}
+	checkpointPath := *optCheckpoint
+	resume := *optResume
+	if resume && checkpointPath == "" {
+		return errors.New("--checkpoint must be set if --resume is specified")
+	}
+	if resume && *optOutput == "" && *optSink == "" {
+		return errors.New("--output or --sink must be set if --resume is specified, lines written to stdout can not be removed")
+	}
+	var checkpoint *rapidCheckpoint
+	if checkpointPath != "" {
+		checkpoint = &rapidCheckpoint{
+			Filter:         filter,
+			Start:          start.UnixNano(),
+			End:            end.UnixNano(),
+			StartOption:    *optStart,
+			EndOption:      *optEnd,
+			DurationOption: *optDuration,
+			Format:         formatName,
+			Fields:         outputFieldSpecs(fields),
+			TimeFormat:     *optTimeFormat,
+			Timezone:       *optTimezone,
+			Where:          *optWhere,
+			NextMinute:     start.Unix() / 60,
+		}
 	}
-	var createFormatter func([]string) Formatter
-	switch *optFormat {
-	case "":
-		createFormatter = newFormatterJSON
-	case "json":
-		createFormatter = newFormatterJSON
-	case "csv":
-		createFormatter = newFormatterCSV
-	default:
-		return fmt.Errorf("--format: '%v' not supported", *optFormat)
+	if resume {
+		saved, serr := loadRapidCheckpoint(checkpointPath)
+		if serr != nil {
+			return serr
+		}
+		if serr := saved.matches(checkpoint); serr != nil {
+			return fmt.Errorf("--resume: %v", serr)
+		}
+		// Relative datetimes are resolved when the download started, not now
+		start = time.Unix(0, saved.Start)
+		end = time.Unix(0, saved.End)
+		checkpoint.Start = saved.Start
+		checkpoint.End = saved.End
+		if saved.NextMinute > (end.Unix()-1)/60 {
+			fmt.Fprintln(os.Stderr, "Nothing to resume, the download has already been completed")
+			return nil
+		}
+		if saved.Offsets == nil {
+			return errors.New("--resume: checkpoint does not record sizes of the output, it was written by an older version or for stdout")
+		}
+		checkpoint.NextMinute = saved.NextMinute
+		checkpoint.Offsets = saved.Offsets
+	}
+	// Start of the range to be downloaded by rapid.Download
+	downloadStart := start
+	if checkpoint != nil && checkpoint.NextMinute*60 > start.Unix() {
+		downloadStart = time.Unix(checkpoint.NextMinute*60, 0)
 	}
-	paralellCount := *optParalell
+
+	// The output is stopped at the boundary of minutes on SIGINT or SIGTERM
+	ctx, cancel := withShutdownSignals(context.Background())
+	defer cancel()
 
 	// Load config and make client parameter
 	err = initConfig()
@@ -406,97 +232,188 @@ func subCmdRapid(args []string) (err error) {
 	if serr != nil {
 		return serr
 	}
-
-	format := "json"
-	ssp := exdgo.SnapshotParam{
-		At:       start,
-		Exchange: exchange,
-		Channels: []string{channel},
-		Format:   &format,
-	}
-	// Download snapshots and the channel definition
-	ss, serr := exdgo.HTTPSnapshot(cp, ssp)
-	if serr != nil {
-		return serr
-	}
-	if len(ss) == 0 {
-		// This channel is not available at this timestamp
-		return fmt.Errorf("channel '%s' is not available at %v", channel, start.Format(time.RFC3339))
+	// Latencies of requests are observed closer to the network than the limit so that they do not include waits
+	var wrappers []func(next http.RoundTripper) http.RoundTripper
+	var metrics *rapidMetrics
+	if *optMetricsAddr != "" {
+		metrics, err = newRapidMetrics(*optMetricsAddr)
+		if err != nil {
+			return
+		}
+		defer metrics.Close()
+		wrappers = append(wrappers, metrics.instrument)
+	}
+	// The download is stopped in the same way as signals when the quota reaches --min-quota
+	var quotaExhausted int32
+	var onExhausted func()
+	if *optMinQuota >= 0 {
+		onExhausted = func() {
+			atomic.StoreInt32(&quotaExhausted, 1)
+			cancel()
+		}
 	}
-	// Unmarshal the definition
-	def := make(map[string]string)
-	serr = json.Unmarshal(ss[0].Snapshot, &def)
-	if serr != nil {
-		return fmt.Errorf("def: %v", serr)
-	}
-	// Extract keys (fields names) from the definition
-	if fields == nil {
-		fields = make([]string, len(def)+4)
-		i := 0
-		fields[i] = fieldExchange
-		i++
-		fields[i] = fieldType
-		i++
-		fields[i] = fieldTimestamp
-		i++
-		fields[i] = fieldChannel
-		i++
-		for _, field := range sortDefinitionKeys(def) {
-			fields[i] = field
-			i++
-		}
-	}
-	// Create new formatter
-	form := createFormatter(fields)
-	// Prepare buffer to write lines to
-	bufSlice := make([]byte, 0, 100000)
-	buf := bytes.NewBuffer(bufSlice)
-	// Write header
-	err = form.WriteHeader(buf)
+	limiter := newRateLimitTransport(*optMaxRPS, maxBytesPerSec, *optMinQuota, onExhausted)
+	err = installTransport(append(wrappers, limiter.wrap)...)
 	if err != nil {
-		return err
+		return
 	}
-	if _, err = os.Stdout.Write(buf.Bytes()); err != nil {
-		return fmt.Errorf("header: %v", err)
+	// stopped returns the error for the download stopped by the cancellation
+	stopped := func() error {
+		if atomic.LoadInt32(&quotaExhausted) != 0 {
+			return errQuotaExhausted
+		}
+		return errInterrupted
 	}
-	buf.Reset()
-	// Output the rest of snapshots
-	values := make(map[string]interface{})
-	for i := 1; i < len(ss); i++ {
-		err = json.Unmarshal(ss[i].Snapshot, &values)
+	var cache rapid.Cache
+	if !*optNoCache {
+		limit, serr := getCacheLimit(currentConfig)
+		if serr != nil {
+			return serr
+		}
+		cache, err = openMinuteCache(limit, currentConfig.BaseURL)
 		if err != nil {
-			return fmt.Errorf("snapshot: %v", err)
+			return
 		}
-		for key, typ := range def {
-			if val, ok := values[key]; ok && typ == "int" {
-				values[key] = int64(val.(float64))
+	}
+
+	// Download snapshots and definitions of channels
+	defs, snapshots, err := rapid.DownloadSnapshots(ctx, c, filter, start)
+	if ctx.Err() != nil {
+		// Nothing is written yet
+		return stopped()
+	}
+	if err != nil {
+		return
+	}
+	// Create new formatter and sink
+	var form format.Formatter
+	var sink format.Sink
+	if *optSink != "" {
+		// Lines are passed to the sink in JSON, with all fields unless --fields is set
+		form = newFormatterFields(format.NewJSON(outputFieldNames(fields)), fields, timeFormat)
+		sink, err = newSinkOf(*optSink, resume, projectFieldDefinitions(defs, fields))
+		if err != nil {
+			return
+		}
+	} else {
+		// Extract keys (fields names) from the definition
+		names := outputFieldNames(fields)
+		if names == nil {
+			names = []string{format.FieldExchange, format.FieldType, format.FieldTimestamp, format.FieldChannel}
+			names = append(names, defs.Keys()...)
+		}
+		if createFormatter != nil {
+			form = createFormatter(names)
+		} else {
+			// Types of computed columns are determined from the fields they are computed from
+			form, err = format.NewParquet(names, projectFieldDefinitions(defs, fields))
+			if err != nil {
+				return
 			}
 		}
-		values[fieldType] = exdgo.LineTypeMessage
-		values[fieldExchange] = exchange
-		values[fieldChannel] = ss[i].Channel
-		values[fieldTimestamp] = ss[i].Timestamp
-		err = form.WriteTo(buf, values)
+		form = newFormatterFields(form, fields, timeFormat)
+		var rotation sinkRotation
+		rotation, err = makeSinkRotation(*optRotateInterval, *optRotateSize)
+		if err != nil {
+			return
+		}
+		var resumed map[string]int64
+		if resume {
+			resumed = checkpoint.Offsets
+		}
+		sink, err = newSink(*optOutput, resumed, form, rotation, *optCompress)
+		if err != nil {
+			return
+		}
+	}
+	defer func() {
+		serr := sink.Close()
+		if serr != nil {
+			if err != nil {
+				err = fmt.Errorf("%v, originally: %v", serr, err)
+			} else {
+				err = serr
+			}
+		}
+	}()
+	// Prepare buffer to write lines to
+	bufSlice := make([]byte, 0, 100000)
+	buf := bytes.NewBuffer(bufSlice)
+	// Snapshots have already been written if resuming
+	for i := 0; i < len(snapshots) && !resume; i++ {
+		if where != nil && !where.match(snapshots[i]) {
+			continue
+		}
+		err = form.WriteTo(buf, snapshots[i])
 		if err != nil {
 			return err
 		}
-		// Clear values map, this will be optimized by the compiler
-		for key := range values {
-			delete(values, key)
+		if err = sink.Route(snapshots[i][format.FieldExchange].(string), snapshots[i][format.FieldChannel].(string), start.UnixNano()); err != nil {
+			return
 		}
-		if _, err = os.Stdout.Write(buf.Bytes()); err != nil {
+		if _, err = sink.Write(buf.Bytes()); err != nil {
 			return fmt.Errorf("snapshot: %v", err)
 		}
+		if metrics != nil {
+			metrics.written(buf.Len(), 1, false)
+		}
 		buf.Reset()
 	}
+	if checkpoint != nil {
+		// Lines must be in the storage before the checkpoint records them, or they are lost on a crash
+		err = syncSink(sink)
+		if err == nil {
+			err = checkpoint.recordOffsets(sink)
+		}
+	} else {
+		err = sink.Flush()
+	}
+	if err != nil {
+		return
+	}
 	// Free memory
 	buf = nil
 	bufSlice = nil
+	if checkpoint != nil {
+		// Record that the header and snapshots are written
+		if err = checkpoint.save(checkpointPath); err != nil {
+			return
+		}
+	}
 	// Fetch and output in paralell
-	rd := newRapidDownload(context.Background(), c, paralellCount, exchange, channel, start, end, def, form)
+	opts := rapid.Options{
+		Filter:      filter,
+		Start:       downloadStart,
+		End:         end,
+		Parallel:    paralellCount,
+		Adaptive:    adaptive,
+		Retry:       retry,
+		Cache:       cache,
+		Definitions: defs,
+		Formatter:   form,
+		MaxMemory:   maxMemory,
+	}
+	if where != nil {
+		opts.Where = where.match
+	}
+	if cache != nil {
+		var cacheErrorOnce sync.Once
+		opts.OnCacheError = func(serr error) {
+			// Only the first is shown, the number of errors is shown in the summary
+			cacheErrorOnce.Do(func() {
+				fmt.Fprintf(os.Stderr, "\nIgnored an error of the cache, minutes are downloaded without it: %v\n", serr)
+			})
+		}
+	}
+	if ctx.Err() != nil {
+		rapidReportInterrupted(downloadStart, checkpointPath)
+		return stopped()
+	}
+	rd := rapid.New(ctx, c, opts)
 	defer func() {
 		serr := rd.Close()
-		if serr != nil {
+		// Errors caused by the cancellation are not reported
+		if serr != nil && !errors.Is(err, errInterrupted) && !errors.Is(err, errQuotaExhausted) {
 			if err != nil {
 				err = fmt.Errorf("%v, originally: %v", serr, err)
 			} else {
@@ -504,17 +421,63 @@ func subCmdRapid(args []string) (err error) {
 			}
 		}
 	}()
+	if metrics != nil {
+		metrics.watch(rd)
+	}
 	stopProg := make(chan struct{})
-	defer close(stopProg)
-	go rapidShowProgress(rd, stopProg)
+	progDone := make(chan struct{})
+	defer func() {
+		// Wait for the summary to be shown before exiting
+		close(stopProg)
+		<-progDone
+	}()
+	go func() {
+		rapidShowProgress(rd, adaptive, limiter, stopProg)
+		close(progDone)
+	}()
+	// Start of lines which have not yet been written
+	next := downloadStart
 	for {
-		if buf, ok, serr := rd.Get(); ok {
-			if _, err = os.Stdout.Write(buf.Bytes()); err != nil {
+		if chunk, ok, serr := rd.Next(); ok {
+			if err = rapidWriteChunk(sink, chunk); err != nil {
 				return
 			}
-			if err = rd.ReturnBuffer(buf); serr != nil {
+			if checkpoint != nil {
+				// Lines must be in the storage before the checkpoint records them,
+				// or they are duplicated or lost on resume after a crash
+				err = syncSink(sink)
+				if err == nil {
+					err = checkpoint.recordOffsets(sink)
+				}
+			} else {
+				err = sink.Flush()
+			}
+			if err != nil {
+				return
+			}
+			if metrics != nil {
+				metrics.written(len(chunk.Bytes()), chunk.Lines(), true)
+			}
+			if checkpoint != nil {
+				// A buffer holds the data of a minute, and buffers are returned in order
+				checkpoint.NextMinute++
+				if err = checkpoint.save(checkpointPath); err != nil {
+					return
+				}
+			}
+			next = chunk.Minute().Add(time.Minute)
+			if err = rd.Release(chunk); err != nil {
 				return
 			}
+			if ctx.Err() != nil {
+				// The minute written just now is complete, stop before the next minute
+				rapidReportInterrupted(next, checkpointPath)
+				return stopped()
+			}
+		} else if ctx.Err() != nil {
+			// The error is caused by the cancellation
+			rapidReportInterrupted(next, checkpointPath)
+			return stopped()
 		} else if serr != nil {
 			err = serr
 			return
@@ -524,50 +487,63 @@ func subCmdRapid(args []string) (err error) {
 	}
 }
 
-func rapidShowProgress(rd *rapidDownload, stop chan struct{}) {
+// rapidWriteChunk writes lines in the chunk to the sink.
+// Sinks which do not route lines take the whole chunk at once.
+func rapidWriteChunk(sink format.Sink, chunk *rapid.Chunk) error {
+	if cs, ok := sink.(chunkSink); ok {
+		return cs.WriteChunk(chunk.Bytes())
+	}
+	return chunk.WriteTo(sink)
+}
+
+// rapidReportInterrupted shows where the output has been written to and how to resume.
+func rapidReportInterrupted(next time.Time, checkpointPath string) {
+	fmt.Fprintf(os.Stderr, "Stopped, lines before %s (minute %d) have been written\n", next.UTC().Format(time.RFC3339), next.Unix()/60)
+	if checkpointPath != "" {
+		fmt.Fprintf(os.Stderr, "Run with --resume --checkpoint %s to resume\n", checkpointPath)
+	} else {
+		fmt.Fprintf(os.Stderr, "Run with --start %s to continue\n", next.UTC().Format(time.RFC3339Nano))
+	}
+}
+
+func rapidShowProgress(rd *rapid.Download, adaptive bool, limiter *rateLimitTransport, stop chan struct{}) {
 	started := time.Now()
 	tim := time.NewTicker(500 * time.Millisecond)
 	defer tim.Stop()
-	// var sb strings.Builder
-	defer fmt.Fprint(os.Stderr, "\n")
 	for {
 		select {
 		case <-tim.C:
-			// Show buffer status
-			// st := make([]rapidDownloadStage, len(rd.buffer))
-			// for i, slot := range rd.buffer {
-			// 	st[i] = slot.stage
-			// }
-			// for _, s := range st {
-			// 	switch s {
-			// 	case rapidDownloadStateEmpty:
-			// 		sb.WriteRune(' ')
-			// 	case rapidDownloadStagePreparing:
-			// 		sb.WriteRune('p')
-			// 	case rapidDownloadStageDownloading:
-			// 		sb.WriteRune('d')
-			// 	case rapidDownloadStageProcessing:
-			// 		sb.WriteRune('P')
-			// 	case rapidDownloadStageDone:
-			// 		sb.WriteRune('d')
-			// 	case rapidDownloadStageWatingOthers:
-			// 		sb.WriteRune('w')
-			// 	case rapidDownloadStageWatingBufferReturn:
-			// 		sb.WriteRune('W')
-			// 	default:
-			// 		sb.WriteRune('o')
-			// 	}
-			// }
-			// // Ignore error
-			// fmt.Fprintf(os.Stderr, "\r|%s|", sb.String())
-			// sb.Reset()
 			// Show time estimate
+			stats := rd.Stats()
 			now := time.Now()
-			perc := float64(rd.readPos) / float64(rd.fp.End.Sub(*rd.fp.Start)/time.Minute)
+			perc := float64(stats.ReadMinutes) / float64(stats.End.Sub(stats.Start)/time.Minute)
 			elapsed := now.Sub(started)
 			estimate := time.Duration(float64(elapsed)/perc) - elapsed
-			fmt.Fprintf(os.Stderr, "\rElapsed: %s Estimate: %v", elapsed, estimate)
+			var extra string
+			if adaptive {
+				extra += fmt.Sprintf(" Paralell: %d", stats.Parallel)
+			}
+			if remaining, limit := limiter.quota(); remaining >= 0 {
+				extra += fmt.Sprintf(" Quota: %d/%d", remaining, limit)
+			}
+			if extra != "" {
+				// Trailing spaces clear longer numbers shown before
+				extra += "  "
+			}
+			fmt.Fprintf(os.Stderr, "\rElapsed: %s Estimate: %v%s", elapsed, estimate, extra)
 		case <-stop:
+			fmt.Fprint(os.Stderr, "\n")
+			// Show the summary of retries
+			stats := rd.Stats()
+			if stats.RetriedMinutes > 0 {
+				fmt.Fprintf(os.Stderr, "%d minute(s) needed retries, %d retries in total\n", stats.RetriedMinutes, stats.Retries)
+			}
+			if stats.CacheErrors > 0 {
+				fmt.Fprintf(os.Stderr, "%d error(s) of the cache were ignored\n", stats.CacheErrors)
+			}
+			if stats.SpilledMinutes > 0 {
+				fmt.Fprintf(os.Stderr, "%d minute(s) were spilled to temporary files to keep --max-memory\n", stats.SpilledMinutes)
+			}
 			return
 		}
 	}
@@ -0,0 +1,108 @@
+package rapid
+
+import "time"
+
+const (
+	// Interval of adjusting the number of routines
+	adjustInterval = time.Second
+	// Number of routines an adaptive download starts with
+	initialAdaptiveParallel = 4
+	// The server or the network is regarded as congested if the latency exceeds this ratio of the lowest latency
+	congestedLatencyRatio = 2
+	// The writer is regarded as the bottleneck if the manager waits for it more than these ratios of the time
+	writerBoundRatio     = 0.5
+	writerSaturatedRatio = 0.9
+)
+
+// parallelController adjusts the number of running download routines in the way similar to the congestion control of TCP.
+// It increases the number while latencies stay low, and decreases it on errors, throttling or congestion.
+// It is only accessed by the manager routine.
+type parallelController struct {
+	max    int
+	target int
+	// Observations since the last adjustment
+	latencySum   time.Duration
+	latencyCount int
+	writerWait   time.Duration
+	errors       int64
+	throttled    int64
+	lastAdjusted time.Time
+	// Lowest average latency of minutes observed, regarded as the latency without congestion
+	baseLatency time.Duration
+}
+
+func newParallelController(max int, now time.Time) *parallelController {
+	c := new(parallelController)
+	c.max = max
+	c.target = initialAdaptiveParallel
+	if c.target > max {
+		c.target = max
+	}
+	c.lastAdjusted = now
+	return c
+}
+
+// observeLatency records the time spent on requests for a minute.
+func (c *parallelController) observeLatency(latency time.Duration) {
+	if latency <= 0 {
+		// Responses are from the cache
+		return
+	}
+	c.latencySum += latency
+	c.latencyCount++
+}
+
+// observeWriter records the time the manager waited for the writer to take and return a chunk.
+func (c *parallelController) observeWriter(wait time.Duration) {
+	c.writerWait += wait
+}
+
+// backOff returns `target` decreased by a quarter, or by one if it is too small to be decreased by a quarter.
+func backOff(target int) int {
+	if decrease := target / 4; decrease > 1 {
+		return target - decrease
+	}
+	return target - 1
+}
+
+// adjust updates and returns the number of routines from observations since the last adjustment.
+// `errors` and `throttled` are the total numbers of failed requests and ones failed with 429.
+func (c *parallelController) adjust(now time.Time, errors int64, throttled int64) int {
+	elapsed := now.Sub(c.lastAdjusted)
+	writerRatio := float64(c.writerWait) / float64(elapsed)
+	switch {
+	case throttled > c.throttled:
+		// The server asked to slow down
+		c.target /= 2
+	case errors > c.errors:
+		c.target = backOff(c.target)
+	case writerRatio > writerSaturatedRatio:
+		// Minutes downloaded by more routines would only wait for the writer
+		c.target--
+	case writerRatio > writerBoundRatio || c.latencyCount == 0:
+		// Nothing to learn from
+	default:
+		latency := c.latencySum / time.Duration(c.latencyCount)
+		if c.baseLatency == 0 || latency < c.baseLatency {
+			c.baseLatency = latency
+		}
+		if latency > c.baseLatency*congestedLatencyRatio {
+			// More routines only share the same bandwidth
+			c.target = backOff(c.target)
+		} else {
+			c.target += c.target/4 + 1
+		}
+	}
+	if c.target < 1 {
+		c.target = 1
+	} else if c.target > c.max {
+		c.target = c.max
+	}
+	c.latencySum = 0
+	c.latencyCount = 0
+	c.writerWait = 0
+	c.errors = errors
+	c.throttled = throttled
+	c.lastAdjusted = now
+	return c.target
+}
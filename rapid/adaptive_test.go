@@ -0,0 +1,58 @@
+package rapid
+
+import (
+	"testing"
+	"time"
+)
+
+// TestParallelControllerBackOff checks that the target keeps decreasing on errors however small it is.
+func TestParallelControllerBackOff(t *testing.T) {
+	for _, max := range []int{1, 2, 3, 4, 100} {
+		now := time.Unix(0, 0)
+		c := newParallelController(max, now)
+		target := c.target
+		for errors := int64(1); target > 1; errors++ {
+			now = now.Add(adjustInterval)
+			next := c.adjust(now, errors, 0)
+			if next >= target {
+				t.Fatalf("max %d: target %d is not decreased on an error, got %d", max, target, next)
+			}
+			target = next
+		}
+		now = now.Add(adjustInterval)
+		if got := c.adjust(now, 100, 0); got != 1 {
+			t.Errorf("max %d: target = %d below the minimum", max, got)
+		}
+	}
+}
+
+func TestParallelControllerAdjust(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    int
+		errors    int64
+		throttled int64
+		latency   time.Duration
+		want      int
+	}{
+		{"error", 3, 1, 0, 0, 2},
+		{"error", 2, 1, 0, 0, 1},
+		{"error", 8, 1, 0, 0, 6},
+		{"throttled", 3, 1, 1, 0, 1},
+		{"throttled", 1, 1, 1, 0, 1},
+		{"congested", 3, 0, 0, 3 * time.Second, 2},
+		{"fast", 3, 0, 0, time.Second, 4},
+	}
+	for _, test := range tests {
+		now := time.Unix(0, 0)
+		c := newParallelController(100, now)
+		c.target = test.target
+		c.baseLatency = time.Second
+		if test.latency > 0 {
+			c.observeLatency(test.latency)
+		}
+		if got := c.adjust(now.Add(adjustInterval), test.errors, test.throttled); got != test.want {
+			t.Errorf("%s from %d = %d, want %d", test.name, test.target, got, test.want)
+		}
+	}
+}
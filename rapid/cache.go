@@ -0,0 +1,24 @@
+package rapid
+
+import "github.com/exchangedataset/exdgo"
+
+// CacheKey identifies the response of a filter request for a whole minute.
+type CacheKey struct {
+	Exchange string
+	// Sorted
+	Channels []string
+	// Unixtime / 60
+	Minute int64
+	Format string
+	// Base URL of the API server the response is from, empty for the official server
+	BaseURL string
+}
+
+// Cache stores responses of filter requests for whole minutes so that they are not downloaded again.
+// Methods are called concurrently from download routines.
+type Cache interface {
+	// Get returns lines stored for `key`, `ok` is false if they are not stored.
+	Get(key CacheKey) (lines []exdgo.StringLine, ok bool, err error)
+	// Put stores lines for `key`.
+	Put(key CacheKey, lines []exdgo.StringLine) error
+}
@@ -0,0 +1,810 @@
+// Package rapid downloads lines of Exchangedataset in paralell and formats them,
+// returning formatted lines as chunks of minutes in the order of time.
+//
+// A download is made by New with definitions and snapshots from DownloadSnapshots,
+// and its chunks are read by Next and given back by Release until Next returns false:
+//
+//	for {
+//		chunk, ok, err := d.Next()
+//		if !ok {
+//			// err is nil if all minutes are returned
+//			break
+//		}
+//		chunk.WriteTo(sink)
+//		d.Release(chunk)
+//	}
+package rapid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/exchangedataset/exd-cli/format"
+	"github.com/exchangedataset/exdgo"
+)
+
+// Stage is the stage of a slot of the download buffer, which holds a minute being downloaded or waiting to be read.
+type Stage int
+
+// Stages of a slot, a minute goes through them in this order except for retries.
+const (
+	// StageEmpty is the slot with no minute, which can be used for the next minute
+	StageEmpty = Stage(iota)
+	// StagePreparing is the slot given to a download routine which has not started yet
+	StagePreparing
+	// StageDownloading is the slot whose minute is being requested to the server
+	StageDownloading
+	// StageWaitingRetry is the slot waiting to retry a failed request
+	StageWaitingRetry
+	// StageProcessing is the slot whose downloaded lines are being formatted
+	StageProcessing
+	// StageDone is the slot whose minute is formatted but not yet received by the manager routine
+	StageDone
+	// StageWaitingOthers is the slot whose minute waits for earlier minutes to be read
+	StageWaitingOthers
+	// StageWaitingBufferReturn is the slot whose minute is returned from Next and waits for Release
+	StageWaitingBufferReturn
+)
+
+// Stages lists all stages in order.
+var Stages = []Stage{
+	StageEmpty,
+	StagePreparing,
+	StageDownloading,
+	StageWaitingRetry,
+	StageProcessing,
+	StageDone,
+	StageWaitingOthers,
+	StageWaitingBufferReturn,
+}
+
+var stageNames = map[Stage]string{
+	StageEmpty:               "empty",
+	StagePreparing:           "preparing",
+	StageDownloading:         "downloading",
+	StageWaitingRetry:        "waiting_retry",
+	StageProcessing:          "processing",
+	StageDone:                "done",
+	StageWaitingOthers:       "waiting_others",
+	StageWaitingBufferReturn: "waiting_buffer_return",
+}
+
+// String returns the name of the stage such as 'downloading'.
+func (s Stage) String() string {
+	if name, ok := stageNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Stage(%d)", int(s))
+}
+
+// Initial capacity of buffers of chunks if the memory is not limited
+const defaultBufferSize = 10 * 1024 * 1024
+
+type downloadSlot struct {
+	chunk *Chunk
+	// Stage of the slot, accessed atomically as the manager routine checks slots used by download routines
+	stage int32
+	// Bytes of the buffer of the chunk counted in the memory usage
+	size int64
+}
+
+// Chunk is formatted lines of a minute.
+// It is reused after it is released, so its data must not be used after that.
+type Chunk struct {
+	minute time.Time
+	buf    *bytes.Buffer
+	// Routes of lines in `buf` in order, used to route lines to files
+	routes []Route
+	// Number of lines in `buf`
+	lines int
+	// Path to the file the data is spilled to, empty if it is in `buf`
+	spilled string
+}
+
+// Route is the exchange, channel and timestamp of lines in a chunk ending at `End`.
+type Route struct {
+	Exchange  string
+	Channel   string
+	Timestamp int64
+	// Offset in the data of the chunk where lines of this route end
+	End int
+}
+
+// Minute returns the start of the minute of the chunk.
+func (c *Chunk) Minute() time.Time {
+	return c.minute
+}
+
+// Bytes returns formatted lines in the chunk.
+func (c *Chunk) Bytes() []byte {
+	return c.buf.Bytes()
+}
+
+// Lines returns the number of lines in the chunk.
+func (c *Chunk) Lines() int {
+	return c.lines
+}
+
+// Routes returns routes of lines in the chunk in order.
+func (c *Chunk) Routes() []Route {
+	return c.routes
+}
+
+// WriteTo writes lines in the chunk to the sink, routing each of them.
+func (c *Chunk) WriteTo(sink format.Sink) error {
+	data := c.buf.Bytes()
+	pos := 0
+	for _, route := range c.routes {
+		if serr := sink.Route(route.Exchange, route.Channel, route.Timestamp); serr != nil {
+			return serr
+		}
+		if _, serr := sink.Write(data[pos:route.End]); serr != nil {
+			return serr
+		}
+		pos = route.End
+	}
+	return nil
+}
+
+// downloadResult is the data and its metadata or error during process of child worker (download worker) as the result.
+type downloadResult struct {
+	pos int
+	err error
+	// Total time spent on requests for the minute, zero if all responses are from the cache
+	latency time.Duration
+}
+
+// Download downloads filter data from the server in paralell way, and is optimized for this purpose to utilize high speed internet connection
+// and the resource of the host computer.
+// Formatted lines are read as chunks of minutes in order by Next.
+type Download struct {
+	// Formatter used to format the response
+	form format.Formatter
+	// Definitions of messages at the start of the range
+	defs format.Definitions
+	// Lines are output only if this is true for them, nil if all lines are output
+	where func(values map[string]interface{}) bool
+	// exdgo.Client used to call HTTPFilter
+	c *exdgo.Client
+	// Map of exchanges and its channels to download
+	filter map[string][]string
+	// Exchanges in `filter` in the sorted order so that lines with the same timestamp are always in the same order
+	exchanges []string
+	// Range of data to download, end is exclusive
+	start time.Time
+	end   time.Time
+	// Maximum number of how much routines will work to download data parallelly
+	parallelCount int
+	// Policy for retrying failed requests
+	retry RetryPolicy
+	// Local cache of responses, nil if disabled
+	cache Cache
+	// Called when the cache fails, nil if not set
+	onCacheError func(err error)
+	// Number of errors of the cache ignored, accessed atomically
+	cacheErrors int64
+	// Number of minutes needed at least one retry, accessed atomically
+	retriedMinutes int64
+	// Total number of retries, accessed atomically
+	retries int64
+	// Number of failed requests including ones retried, accessed atomically
+	requestErrors int64
+	// Number of requests failed with 429 Too Many Requests, accessed atomically
+	throttled int64
+	// Adjusts the number of running routines, nil if it is fixed to parallelCount
+	adaptive *parallelController
+	// Number of minutes allowed to be downloading or waiting to be read at the same time, accessed atomically
+	target int64
+	// Number of minutes downloaded and processed, accessed atomically
+	downloadedMinutes int64
+	// Maximum bytes of buffers of chunks, zero if not limited
+	maxMemory int64
+	// Initial capacity of buffers of chunks
+	bufferSize int
+	// Bytes of buffers of chunks being downloaded or waiting to be read and responses being formatted, accessed atomically
+	memory int64
+	// Number of minutes spilled to files, accessed atomically
+	spilledMinutes int64
+	// Buffer of downloaded data that can not be sent out because the earlier data has not yet been avaiable
+	// Has a size of parallelCount
+	buffer []downloadSlot
+	// Number of slots of the buffer in each stage indexed by Stage, accessed atomically
+	stages []int64
+	// Position in the buffer where data has not yet been available
+	readPos int
+	// Copy of `readPos` for Stats, accessed atomically
+	readMinutes int64
+	// Position in the buffer where the result from the next soon-be-lauched download routine will be stored
+	writePos int
+	// Number of routines currently running or waiting for data retrival via a channel
+	running int
+	// Context the manager routine will run on
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+	// Channel to which the manager routine and its download routines will send an error
+	// An error will be send only once and never
+	err chan error
+	// The last error to be observed
+	lastError error
+	// Channel to which the result will be sent from the manager routine
+	out chan *Chunk
+	// Channel to which the caller will return `Chunk` from
+	ret chan *Chunk
+	// Indicates if this is closed or not
+	closed bool
+}
+
+// setStage moves the slot to the stage, counting slots in each stage for Stats.
+// It must be called only by the routine using the slot.
+func (r *Download) setStage(slot *downloadSlot, stage Stage) {
+	atomic.AddInt64(&r.stages[slot.getStage()], -1)
+	atomic.AddInt64(&r.stages[stage], 1)
+	atomic.StoreInt32(&slot.stage, int32(stage))
+}
+
+func (s *downloadSlot) getStage() Stage {
+	return Stage(atomic.LoadInt32(&s.stage))
+}
+
+// convertMessageValues converts values of a message according to its definition.
+func convertMessageValues(values map[string]interface{}, def map[string]string) {
+	for key, typ := range def {
+		if val, ok := values[key]; ok && val != nil && typ == "int" {
+			values[key] = int64(val.(float64))
+		}
+	}
+}
+
+// cacheError records the error of the cache, which never stops the download.
+func (r *Download) cacheError(err error) {
+	atomic.AddInt64(&r.cacheErrors, 1)
+	if r.onCacheError != nil {
+		r.onCacheError(err)
+	}
+}
+
+// downloadFilter calls HTTPFilter for a exchange and retries if the error is temporary.
+// `retried` is set to true if it retried at least once, and the time spent on requests is added to `latency`.
+// The response is read from or stored to the cache if the whole minute is in the range.
+func (r *Download) downloadFilter(ctx context.Context, fp exdgo.FilterParam, slot *downloadSlot, retried *bool, latency *time.Duration) (lines []exdgo.StringLine, err error) {
+	var key *CacheKey
+	if r.cache != nil && !fp.Minute.Before(*fp.Start) && !fp.Minute.Add(time.Minute).After(*fp.End) {
+		channels := make([]string, len(fp.Channels))
+		copy(channels, fp.Channels)
+		sort.Strings(channels)
+		key = &CacheKey{
+			Exchange: fp.Exchange,
+			Channels: channels,
+			Minute:   fp.Minute.Unix() / 60,
+			Format:   *fp.Format,
+		}
+		cached, ok, serr := r.cache.Get(*key)
+		if serr != nil {
+			// The cache is an optimization, the minute is downloaded instead
+			r.cacheError(serr)
+		} else if ok {
+			return cached, nil
+		}
+		defer func() {
+			if err == nil {
+				if serr := r.cache.Put(*key, lines); serr != nil {
+					r.cacheError(serr)
+				}
+			}
+		}()
+	}
+	for attempt := 0; ; attempt++ {
+		r.setStage(slot, StageDownloading)
+		requested := time.Now()
+		lines, err = r.c.HTTPFilterWithContext(ctx, fp)
+		*latency += time.Since(requested)
+		if err == nil {
+			return
+		}
+		atomic.AddInt64(&r.requestErrors, 1)
+		if statusCodeOf(err) == http.StatusTooManyRequests {
+			atomic.AddInt64(&r.throttled, 1)
+		}
+		if attempt >= r.retry.MaxRetries || !IsRetryableError(ctx, err) {
+			err = fmt.Errorf("%s minute %d: %v", fp.Exchange, fp.Minute.Unix()/60, err)
+			return
+		}
+		if !*retried {
+			atomic.AddInt64(&r.retriedMinutes, 1)
+			*retried = true
+		}
+		atomic.AddInt64(&r.retries, 1)
+		r.setStage(slot, StageWaitingRetry)
+		if !r.retry.sleep(ctx, attempt) {
+			err = ctx.Err()
+			return
+		}
+	}
+}
+
+func (r *Download) download(ctx context.Context, minute time.Time, slot *downloadSlot, pos int, resultCh chan downloadResult) {
+	var err error
+	// Bytes of responses and the growth of the buffer counted in the memory by this routine
+	// They are uncounted before the result is sent, the manager counts the buffer of the slot instead
+	var inflight int64
+	defer func() {
+		atomic.AddInt64(&r.memory, -inflight)
+		if err != nil {
+			resultCh <- downloadResult{
+				pos: pos,
+				err: err,
+			}
+		}
+	}()
+	lineFormat := "json"
+	slot.chunk.minute = minute
+	// Lines of each exchange, each of them are sorted by timestamp
+	shards := make([][]exdgo.StringLine, 0, len(r.filter))
+	retried := false
+	var latency time.Duration
+	var grown int64
+	for _, exchange := range r.exchanges {
+		var lines []exdgo.StringLine
+		lines, err = r.downloadFilter(ctx, exdgo.FilterParam{
+			Exchange: exchange,
+			Channels: r.filter[exchange],
+			Minute:   minute,
+			Start:    &r.start,
+			End:      &r.end,
+			Format:   &lineFormat,
+		}, slot, &retried, &latency)
+		if err != nil {
+			return
+		}
+		size := responseSize(lines)
+		atomic.AddInt64(&r.memory, size)
+		inflight += size
+		shards = append(shards, lines)
+	}
+	r.setStage(slot, StageProcessing)
+	// Definitions learned in this minute after the start line
+	// Definitions of later minutes running in paralell can not be known, they use definitions from the snapshot
+	learned := make(format.Definitions)
+	values := make(map[string]interface{})
+	// Merge lines of exchanges in timestamp order
+	for {
+		next := -1
+		for i, lines := range shards {
+			if len(lines) > 0 && (next == -1 || lines[0].Timestamp < shards[next][0].Timestamp) {
+				next = i
+			}
+		}
+		if next == -1 {
+			break
+		}
+		line := shards[next][0]
+		shards[next] = shards[next][1:]
+		if line.Type == exdgo.LineTypeMessage {
+			def, ok := learned[line.Exchange][*line.Channel]
+			if !ok {
+				if _, reset := learned[line.Exchange]; !reset {
+					def, ok = r.defs[line.Exchange][*line.Channel]
+				}
+			}
+			if !ok {
+				// The first message after the start line is the definition
+				def = make(map[string]string)
+				err = json.Unmarshal(line.Message, &def)
+				if err != nil {
+					return
+				}
+				learned.Set(line.Exchange, *line.Channel, def)
+				continue
+			}
+			err = json.Unmarshal(line.Message, &values)
+			if err != nil {
+				return
+			}
+			convertMessageValues(values, def)
+		} else if line.Type == exdgo.LineTypeStart {
+			// Definitions will be sent again after the start line
+			learned[line.Exchange] = make(map[string]map[string]string)
+			continue
+		}
+		values[format.FieldExchange] = line.Exchange
+		values[format.FieldType] = line.Type
+		if line.Channel != nil {
+			values[format.FieldChannel] = *line.Channel
+		}
+		values[format.FieldTimestamp] = line.Timestamp
+		// Lines not matching the condition are skipped, the map is still cleared below
+		if r.where == nil || r.where(values) {
+			err = r.form.WriteTo(slot.chunk.buf, values)
+			if err != nil {
+				return
+			}
+			if size := int64(slot.chunk.buf.Cap()) - slot.size; size > grown {
+				atomic.AddInt64(&r.memory, size-grown)
+				inflight += size - grown
+				grown = size
+			}
+			slot.chunk.lines++
+			var channel string
+			if line.Channel != nil {
+				channel = *line.Channel
+			}
+			routes := slot.chunk.routes
+			if last := len(routes) - 1; last >= 0 && routes[last].Exchange == line.Exchange && routes[last].Channel == channel && routes[last].Timestamp == line.Timestamp {
+				routes[last].End = slot.chunk.buf.Len()
+			} else {
+				slot.chunk.routes = append(routes, Route{
+					Exchange:  line.Exchange,
+					Channel:   channel,
+					Timestamp: line.Timestamp,
+					End:       slot.chunk.buf.Len(),
+				})
+			}
+		}
+		// This will be optimized by the compiler
+		for key := range values {
+			delete(values, key)
+		}
+	}
+	atomic.AddInt64(&r.memory, -inflight)
+	inflight = 0
+	r.setStage(slot, StageDone)
+	atomic.AddInt64(&r.downloadedMinutes, 1)
+	resultCh <- downloadResult{
+		pos:     pos,
+		latency: latency,
+	}
+}
+
+// manager is the function intended to be ran as a routine that manages multiple worker routine (download routine)
+// and the waiting buffer where data be stored when the sequentially ealier data are not yet available.
+func (r *Download) manager() {
+	// This ensures the manager sends an error only once
+	var err error
+	defer func() {
+		if err != nil {
+			r.err <- fmt.Errorf("manager: %w", err)
+		}
+		close(r.err)
+	}()
+	// Close out channel first so r.err will be listened
+	defer close(r.out)
+	startMinute := r.start.Unix() / 60
+	endMinute := (r.end.Unix() - 1) / 60
+	// Channel to which child routines (download routines) will use to send the result
+	results := make(chan downloadResult)
+	// This defer function will ensure no running goroutines will be left out before this manager routine is stopped
+	defer func() {
+		for r.running > 0 {
+			// Ignore errors
+			<-results
+			r.running--
+		}
+	}()
+	// Files of minutes spilled but not yet sent out are removed on errors and the cancellation
+	defer func() {
+		for i := range r.buffer {
+			if chunk := r.buffer[i].chunk; chunk != nil {
+				chunk.removeSpilled()
+			}
+		}
+	}()
+	// Cancel this context to stop all child routines
+	ctx, cancel := context.WithCancel(r.ctx)
+	defer cancel()
+	// Ticks only if the number of routines is adjusted
+	var adjust <-chan time.Time
+	if r.adaptive != nil {
+		tick := time.NewTicker(adjustInterval)
+		defer tick.Stop()
+		adjust = tick.C
+	}
+	for {
+		if r.ctx.Err() != nil {
+			// Do not launch new routines once cancelled
+			err = r.ctx.Err()
+			return
+		}
+		// Launch new routines while there are empty slots and futher fetching is needed
+		// Minutes waiting to be read are limited by the target as well as running ones,
+		// or finished minutes could fill all slots of an adaptive download
+		target := int(atomic.LoadInt64(&r.target))
+		for ; startMinute+int64(r.writePos) <= endMinute && r.writePos-r.readPos < target; r.writePos++ {
+			if r.maxMemory > 0 && r.running > 0 && atomic.LoadInt64(&r.memory)+int64(r.bufferSize) > r.maxMemory {
+				// Wait for buffers to be returned or spilled, at least one routine is always running
+				break
+			}
+			slot := &r.buffer[r.writePos%r.parallelCount]
+			if slot.chunk == nil {
+				slot.chunk = new(Chunk)
+			}
+			r.setStage(slot, StagePreparing)
+			if slot.chunk.buf == nil {
+				// This bytes buffer will be used to return the result from a download routine
+				// It is reused for later minutes unless the memory is limited
+				slot.chunk.buf = bytes.NewBuffer(make([]byte, 0, r.bufferSize))
+			}
+			r.account(slot)
+			minute := time.Unix((startMinute+int64(r.writePos))*60, 0)
+			go r.download(ctx, minute, slot, r.writePos, results)
+			r.running++
+		}
+		// Did we reached the end?
+		if r.readPos == r.writePos && r.running == 0 {
+			return
+		}
+		// Fetch result from download routines as well as saving them for sending out later
+		select {
+		case result := <-results:
+			r.running--
+			if result.err != nil {
+				// A routine returned error
+				err = fmt.Errorf("download routine, futher errors are ignored: %v", result.err)
+				return
+			}
+			slot := &r.buffer[result.pos%r.parallelCount]
+			if slot.getStage() != StageDone {
+				err = errors.New("received job done, but the slot are not in the done stage")
+				return
+			}
+			r.setStage(slot, StageWaitingOthers)
+			if r.adaptive != nil {
+				r.adaptive.observeLatency(result.latency)
+			}
+			// The buffer could have grown in the routine
+			r.account(slot)
+			if r.maxMemory > 0 && result.pos != r.readPos && atomic.LoadInt64(&r.memory) > r.maxMemory {
+				// This minute has to wait for earlier minutes, move it out of the memory until then
+				err = slot.chunk.spill()
+				if err != nil {
+					return
+				}
+				r.account(slot)
+				atomic.AddInt64(&r.spilledMinutes, 1)
+			}
+			// Send out data in the buffer
+			for ; r.readPos < r.writePos; r.readPos++ {
+				slot := &r.buffer[r.readPos%r.parallelCount]
+				if slot.getStage() != StageWaitingOthers {
+					// This slot is not ready
+					break
+				}
+				err = slot.chunk.unspill()
+				if err != nil {
+					return
+				}
+				r.account(slot)
+				// Time the writer takes is observed to adjust the number of routines
+				waitStarted := time.Now()
+				// Send
+				select {
+				case r.out <- slot.chunk:
+				case <-r.ctx.Done():
+					// Context cancelled
+					err = r.ctx.Err()
+					return
+				}
+				r.setStage(slot, StageWaitingBufferReturn)
+				atomic.StoreInt64(&r.readMinutes, int64(r.readPos+1))
+				// Wait for the buffer to be returned
+				select {
+				case chunk := <-r.ret:
+					// Do not forget to reset buffer
+					chunk.reset()
+					if r.maxMemory > 0 {
+						// Buffers of empty slots are not counted in the memory, free it to keep the limit
+						chunk.buf = nil
+					}
+					slot.chunk = chunk
+				case <-r.ctx.Done():
+					// Context cancelled
+					err = r.ctx.Err()
+					return
+				}
+				if r.adaptive != nil {
+					r.adaptive.observeWriter(time.Since(waitStarted))
+				}
+				r.setStage(slot, StageEmpty)
+				r.account(slot)
+			}
+		case now := <-adjust:
+			target := r.adaptive.adjust(now, atomic.LoadInt64(&r.requestErrors), atomic.LoadInt64(&r.throttled))
+			atomic.StoreInt64(&r.target, int64(target))
+		case <-r.ctx.Done():
+			// Context cancelled
+			err = r.ctx.Err()
+			return
+		}
+	}
+}
+
+// Next returns the chunk of the next minute.
+// `ok` is false if all minutes in the range have been returned or an error occurred.
+// The chunk must be released by Release before the next call.
+func (r *Download) Next() (chunk *Chunk, ok bool, err error) {
+	if r.closed {
+		// If this has already been closed, return the last error
+		return nil, false, r.lastError
+	}
+	select {
+	case chunk, ok = <-r.out:
+		return chunk, ok, nil
+	case err, ok := <-r.err:
+		if !ok {
+			// r.out is also closed
+			return nil, false, nil
+		}
+		r.lastError = fmt.Errorf("rapid Next: %w", err)
+		return nil, false, r.lastError
+	}
+}
+
+// Release returns the chunk returned from Next so that its buffer is reused for later minutes.
+func (r *Download) Release(chunk *Chunk) error {
+	if r.closed {
+		// If this has already been closed, return the last error
+		return r.lastError
+	}
+	select {
+	case r.ret <- chunk:
+	case err, ok := <-r.err:
+		if !ok {
+			// The manager routine is dead
+			return nil
+		}
+		r.lastError = fmt.Errorf("rapid Release: %w", err)
+		return r.lastError
+	}
+	return nil
+}
+
+// Close stops the download and waits for routines to stop.
+// It returns the error occurred during the download if any.
+func (r *Download) Close() error {
+	if r.closed {
+		// If this has already been closed, return the last error
+		return r.lastError
+	}
+	// This stops the manager routine and its childs
+	r.cancelCtx()
+	if err, ok := <-r.err; ok {
+		r.lastError = fmt.Errorf("rapid Close: %w", err)
+		return r.lastError
+	}
+	close(r.ret)
+	// Mark this as closed
+	r.closed = true
+	return nil
+}
+
+// Stats is the progress of a download.
+type Stats struct {
+	// Range of the download, Start is truncated to the minute
+	Start time.Time
+	End   time.Time
+	// Number of minutes returned from Next
+	ReadMinutes int
+	// Number of minutes downloaded and processed, including ones waiting to be returned
+	DownloadedMinutes int64
+	// Number of minutes needed at least one retry
+	RetriedMinutes int64
+	// Total number of retries
+	Retries int64
+	// Number of failed requests including ones retried
+	RequestErrors int64
+	// Bytes of formatted lines and responses being formatted buffered in the memory
+	Memory int64
+	// Number of minutes spilled to temporary files
+	SpilledMinutes int64
+	// Number of minutes allowed to be downloaded at the same time
+	Parallel int
+	// Number of requests failed with 429 Too Many Requests
+	Throttled int64
+	// Number of errors of the cache ignored
+	CacheErrors int64
+	// Number of slots of the buffer in each stage
+	Stages map[Stage]int
+}
+
+// Stats returns the progress of the download.
+// It is safe to call from any routine, values are read one by one and could be slightly inconsistent.
+func (r *Download) Stats() Stats {
+	stats := Stats{
+		Start:             r.start.Truncate(time.Minute),
+		End:               r.end,
+		ReadMinutes:       int(atomic.LoadInt64(&r.readMinutes)),
+		DownloadedMinutes: atomic.LoadInt64(&r.downloadedMinutes),
+		RetriedMinutes:    atomic.LoadInt64(&r.retriedMinutes),
+		Retries:           atomic.LoadInt64(&r.retries),
+		RequestErrors:     atomic.LoadInt64(&r.requestErrors),
+		Parallel:          int(atomic.LoadInt64(&r.target)),
+		Throttled:         atomic.LoadInt64(&r.throttled),
+		CacheErrors:       atomic.LoadInt64(&r.cacheErrors),
+		Memory:            atomic.LoadInt64(&r.memory),
+		SpilledMinutes:    atomic.LoadInt64(&r.spilledMinutes),
+		Stages:            make(map[Stage]int, len(Stages)),
+	}
+	for _, stage := range Stages {
+		stats.Stages[stage] = int(atomic.LoadInt64(&r.stages[stage]))
+	}
+	return stats
+}
+
+// Options is the parameters of a download.
+type Options struct {
+	// Map of exchanges and its channels to download
+	Filter map[string][]string
+	// Range of data to download, end is exclusive
+	Start time.Time
+	End   time.Time
+	// Maximum number of minutes downloaded in paralell, must be positive
+	Parallel int
+	// Adjust the number of minutes downloaded in paralell up to Parallel from
+	// latencies of requests, errors and the time Release takes if true
+	Adaptive bool
+	// Policy for retrying failed requests
+	Retry RetryPolicy
+	// Local cache of responses, optional
+	Cache Cache
+	// Called from download routines when the cache fails, optional
+	// Errors of the cache do not stop the download, the minute is downloaded or left uncached instead
+	OnCacheError func(err error)
+	// Definitions of messages at Start, returned from DownloadSnapshots
+	Definitions format.Definitions
+	// Formatter used to format lines
+	Formatter format.Formatter
+	// Lines are formatted only if this returns true for their values, optional
+	Where func(values map[string]interface{}) bool
+	// Maximum bytes of formatted lines and responses buffered in the memory, zero for no limit
+	// New minutes are not started above it, and minutes waiting for earlier minutes are spilled to temporary files
+	// It is a soft limit, a response is counted only after it is received and started minutes are never stopped
+	MaxMemory int64
+}
+
+// New starts downloading and formatting lines in the range in paralell.
+// Cancel `ctx` or call Close to stop the download.
+func New(ctx context.Context, c *exdgo.Client, opts Options) (r *Download) {
+	r = new(Download)
+	r.ctx, r.cancelCtx = context.WithCancel(ctx)
+	r.c = c
+	r.parallelCount = opts.Parallel
+	r.target = int64(opts.Parallel)
+	if opts.Adaptive {
+		r.adaptive = newParallelController(opts.Parallel, time.Now())
+		r.target = int64(r.adaptive.target)
+	}
+	r.retry = opts.Retry
+	r.cache = opts.Cache
+	r.onCacheError = opts.OnCacheError
+	r.filter = opts.Filter
+	r.exchanges = make([]string, 0, len(opts.Filter))
+	for exchange := range opts.Filter {
+		r.exchanges = append(r.exchanges, exchange)
+	}
+	sort.Strings(r.exchanges)
+	r.start = opts.Start
+	r.end = opts.End
+	r.defs = opts.Definitions
+	r.form = opts.Formatter
+	r.where = opts.Where
+	r.maxMemory = opts.MaxMemory
+	r.bufferSize = defaultBufferSize
+	if r.maxMemory > 0 && r.maxMemory/int64(r.parallelCount) < defaultBufferSize {
+		r.bufferSize = int(r.maxMemory / int64(r.parallelCount))
+	}
+	// All slots of the waiting buffer are empty at first
+	r.buffer = make([]downloadSlot, r.parallelCount)
+	r.stages = make([]int64, len(Stages))
+	r.stages[StageEmpty] = int64(r.parallelCount)
+	r.err = make(chan error)
+	r.out = make(chan *Chunk)
+	r.ret = make(chan *Chunk)
+	go r.manager()
+	return
+}
@@ -0,0 +1,87 @@
+package rapid
+
+import (
+	"context"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exdgo does not wrap errors, so the status code and the cause have to be extracted from the message.
+// Messages of exdgo are pinned by tests.
+var (
+	regexStatusCode = regexp.MustCompile("bad status code (\\d+)")
+	// "request <path>: <error of http.Client>"
+	regexTransportError = regexp.MustCompile("^request [^ ]+: ")
+)
+
+// RetryPolicy is the parameters for retrying failed requests.
+type RetryPolicy struct {
+	// Maximum number of retries for a request, zero disables retrying
+	MaxRetries int
+	// Wait before the first retry, doubled on every retry
+	BaseWait time.Duration
+	// Upper limit of the wait
+	MaxWait time.Duration
+}
+
+// statusCodeOf returns the HTTP status code of the error returned from an API call of exdgo, zero if it has none.
+func statusCodeOf(err error) int {
+	match := regexStatusCode.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0
+	}
+	code, serr := strconv.Atoi(match[1])
+	if serr != nil {
+		return 0
+	}
+	return code
+}
+
+// IsRetryableError reports whether the error returned from an API call of exdgo is temporary and worth retrying.
+// Errors caused by cancellation of `ctx` are never retryable.
+func IsRetryableError(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if code := statusCodeOf(err); code != 0 {
+		// Server errors and throttling are temporary, others (e.g. authentication, bad channel) are not
+		return code >= 500 || code == 429 || code == 408
+	}
+	// Errors while sending a request or reading the response, such as timeouts or connection resets
+	// Others such as an unexpected content-type of 404 are not fixed by retrying
+	msg := err.Error()
+	return regexTransportError.MatchString(msg) || strings.HasPrefix(msg, "body read: ")
+}
+
+// wait returns the duration to wait before the `attempt`-th retry (starting from 0).
+// Exponential backoff with jitter is used so that simultaneously failed requests will not retry all at once.
+func (p RetryPolicy) wait(attempt int) time.Duration {
+	wait := p.BaseWait
+	for i := 0; i < attempt && wait < p.MaxWait; i++ {
+		wait *= 2
+	}
+	if wait > p.MaxWait {
+		wait = p.MaxWait
+	}
+	if wait <= 0 {
+		return 0
+	}
+	// Randomize in the range of [wait/2, wait]
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// sleep waits before the `attempt`-th retry.
+// Returns false if `ctx` is cancelled while waiting.
+func (p RetryPolicy) sleep(ctx context.Context, attempt int) bool {
+	tim := time.NewTimer(p.wait(attempt))
+	defer tim.Stop()
+	select {
+	case <-tim.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
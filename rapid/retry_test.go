@@ -0,0 +1,140 @@
+package rapid
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/exchangedataset/exdgo"
+)
+
+// redirectTransport sends all requests to `target` so that exdgo talks to a test server.
+type redirectTransport struct {
+	target *url.URL
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// filterError returns the error exdgo returns from HTTPFilter for the response of `handler`.
+func filterError(t *testing.T, ctx context.Context, handler http.HandlerFunc) error {
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	target, serr := url.Parse(server.URL)
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	prev := http.DefaultClient.Transport
+	http.DefaultClient.Transport = &redirectTransport{target: target}
+	defer func() { http.DefaultClient.Transport = prev }()
+
+	c, serr := exdgo.CreateClient(exdgo.ClientParam{APIKey: "testkey"})
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	lineFormat := "json"
+	start := time.Unix(26648640*60, 0)
+	end := start.Add(time.Minute)
+	_, err := c.HTTPFilterWithContext(ctx, exdgo.FilterParam{
+		Exchange: "bitmex",
+		Channels: []string{"trade"},
+		Minute:   start,
+		Start:    &start,
+		End:      &end,
+		Format:   &lineFormat,
+	})
+	return err
+}
+
+func respond(status int, contentType string, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}
+}
+
+// TestIsRetryableError pins how errors of exdgo for each kind of failure are classified.
+func TestIsRetryableError(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		retryable bool
+		status    int
+	}{
+		{"service unavailable", respond(503, "application/json", `{"error":"unavailable"}`), true, 503},
+		{"bad gateway", respond(502, "text/html", "<html></html>"), true, 502},
+		{"too many requests", respond(429, "application/json", `{"error":"slow down"}`), true, 429},
+		{"request timeout", respond(408, "text/plain", ""), true, 408},
+		{"unauthorized", respond(401, "application/json", `{"error":"bad api key"}`), false, 401},
+		{"bad request", respond(400, "application/json", `{"message":"bad channel"}`), false, 400},
+		{"not found with json", respond(404, "application/json", `{"error":"not found"}`), false, 0},
+		{"ok with wrong content-type", respond(200, "application/json", "{}"), false, 0},
+		{"connection closed", func(w http.ResponseWriter, r *http.Request) {
+			conn, _, serr := w.(http.Hijacker).Hijack()
+			if serr == nil {
+				conn.Close()
+			}
+		}, true, 0},
+		{"body cut short", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Content-Length", "100")
+			w.WriteHeader(200)
+			w.Write([]byte("short"))
+			conn, _, serr := w.(http.Hijacker).Hijack()
+			if serr == nil {
+				conn.Close()
+			}
+		}, true, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := filterError(t, context.Background(), test.handler)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if got := IsRetryableError(context.Background(), err); got != test.retryable {
+				t.Errorf("IsRetryableError(%q) = %v, want %v", err, got, test.retryable)
+			}
+			if got := statusCodeOf(err); got != test.status {
+				t.Errorf("statusCodeOf(%q) = %d, want %d", err, got, test.status)
+			}
+		})
+	}
+}
+
+func TestIsRetryableErrorCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := filterError(t, ctx, respond(503, "text/plain", ""))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if IsRetryableError(ctx, err) {
+		t.Errorf("IsRetryableError(%q) = true for the cancelled context", err)
+	}
+}
+
+func TestIsRetryableErrorOthers(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{nil, false},
+		{errors.New("invalid filter parameter: invalid characters in 'Exchange'"), false},
+		{errors.New("message read error: unexpected EOF"), false},
+	}
+	for _, test := range tests {
+		if got := IsRetryableError(context.Background(), test.err); got != test.retryable {
+			t.Errorf("IsRetryableError(%v) = %v, want %v", test.err, got, test.retryable)
+		}
+	}
+}
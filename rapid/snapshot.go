@@ -0,0 +1,65 @@
+package rapid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/exchangedataset/exd-cli/format"
+	"github.com/exchangedataset/exdgo"
+)
+
+// DownloadSnapshots downloads snapshots of channels in `filter` at `at`.
+// Returns definitions of channels, and values of snapshots sorted by timestamp.
+// Requests are stopped when `ctx` is cancelled.
+func DownloadSnapshots(ctx context.Context, c *exdgo.Client, filter map[string][]string, at time.Time) (defs format.Definitions, snapshots []map[string]interface{}, err error) {
+	defs = make(format.Definitions)
+	lineFormat := "json"
+	for exchange, channels := range filter {
+		ss, serr := c.HTTPSnapshotWithContext(ctx, exdgo.SnapshotParam{
+			At:       at,
+			Exchange: exchange,
+			Channels: channels,
+			Format:   &lineFormat,
+		})
+		if serr != nil {
+			return nil, nil, serr
+		}
+		for _, s := range ss {
+			def, ok := defs[exchange][s.Channel]
+			if !ok {
+				// The first line of a channel is the definition
+				def = make(map[string]string)
+				serr = json.Unmarshal(s.Snapshot, &def)
+				if serr != nil {
+					return nil, nil, fmt.Errorf("def: %v", serr)
+				}
+				defs.Set(exchange, s.Channel, def)
+				continue
+			}
+			values := make(map[string]interface{})
+			serr = json.Unmarshal(s.Snapshot, &values)
+			if serr != nil {
+				return nil, nil, fmt.Errorf("snapshot: %v", serr)
+			}
+			convertMessageValues(values, def)
+			values[format.FieldType] = exdgo.LineTypeMessage
+			values[format.FieldExchange] = exchange
+			values[format.FieldChannel] = s.Channel
+			values[format.FieldTimestamp] = s.Timestamp
+			snapshots = append(snapshots, values)
+		}
+		for _, channel := range channels {
+			if _, ok := defs[exchange][channel]; !ok {
+				// This channel is not available at this timestamp
+				return nil, nil, fmt.Errorf("channel '%s' of '%s' is not available at %v", channel, exchange, at.Format(time.RFC3339))
+			}
+		}
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool {
+		return snapshots[i][format.FieldTimestamp].(int64) < snapshots[j][format.FieldTimestamp].(int64)
+	})
+	return
+}
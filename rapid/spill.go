@@ -0,0 +1,86 @@
+package rapid
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+
+	"github.com/exchangedataset/exdgo"
+)
+
+// account updates the memory usage with the current size of the buffer of the slot.
+// Only slots holding a minute are counted, buffers of empty slots are kept only for reuse.
+// It must be called only by the manager routine while no download routine is using the slot.
+func (r *Download) account(slot *downloadSlot) {
+	var size int64
+	if slot.getStage() != StageEmpty && slot.chunk != nil && slot.chunk.buf != nil {
+		size = int64(slot.chunk.buf.Cap())
+	}
+	atomic.AddInt64(&r.memory, size-slot.size)
+	slot.size = size
+}
+
+// Bytes counted for a line of a response besides its message
+const lineOverhead = 64
+
+// responseSize returns the estimated bytes of lines of a response held in the memory.
+func responseSize(lines []exdgo.StringLine) (size int64) {
+	for i := range lines {
+		size += lineOverhead + int64(len(lines[i].Message))
+	}
+	return
+}
+
+// reset empties the chunk so that it can be used for another minute.
+func (c *Chunk) reset() {
+	if c.buf != nil {
+		c.buf.Reset()
+	}
+	c.routes = c.routes[:0]
+	c.lines = 0
+}
+
+// spill writes the data of the chunk to a temporary file and frees the buffer.
+func (c *Chunk) spill() error {
+	f, serr := ioutil.TempFile("", "exd-rapid-*.tmp")
+	if serr != nil {
+		return fmt.Errorf("spill: %v", serr)
+	}
+	_, serr = f.Write(c.buf.Bytes())
+	if cerr := f.Close(); serr == nil {
+		serr = cerr
+	}
+	if serr != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("spill: %v", serr)
+	}
+	c.spilled = f.Name()
+	c.buf = nil
+	return nil
+}
+
+// unspill reads the data spilled to the file back to the buffer.
+// It does nothing if the chunk is not spilled.
+func (c *Chunk) unspill() error {
+	if c.spilled == "" {
+		return nil
+	}
+	data, serr := ioutil.ReadFile(c.spilled)
+	if serr != nil {
+		return fmt.Errorf("unspill: %v", serr)
+	}
+	c.removeSpilled()
+	c.buf = bytes.NewBuffer(data)
+	return nil
+}
+
+// removeSpilled removes the file the chunk is spilled to if any.
+func (c *Chunk) removeSpilled() {
+	if c.spilled != "" {
+		// The file is in the temporary directory, ignore errors
+		os.Remove(c.spilled)
+		c.spilled = ""
+	}
+}
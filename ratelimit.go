@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Headers of the usage of the API plan, read if the server returns them
+const (
+	headerRateLimitLimit     = "X-RateLimit-Limit"
+	headerRateLimitRemaining = "X-RateLimit-Remaining"
+)
+
+// tokenBucket allows `rate` tokens per second with bursts up to `burst` tokens.
+// It is shared by routines, tokens are given in the order they are requested.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	b := new(tokenBucket)
+	b.rate = rate
+	b.burst = burst
+	b.tokens = burst
+	b.last = time.Now()
+	return b
+}
+
+// wait takes `n` tokens, waiting until they are available.
+// Tokens can be borrowed from the future so that `n` more than the burst does not wait forever.
+// Returns the error of `ctx` if it is done while waiting.
+func (b *tokenBucket) wait(ctx context.Context, n float64) error {
+	b.mutex.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= n
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mutex.Unlock()
+	if delay == 0 {
+		return nil
+	}
+	tim := time.NewTimer(delay)
+	defer tim.Stop()
+	select {
+	case <-tim.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimitTransport limits requests and bytes of responses of all routines,
+// and keeps track of the remaining quota of the API plan.
+type rateLimitTransport struct {
+	next http.RoundTripper
+	// nil if not limited
+	requests *tokenBucket
+	bytes    *tokenBucket
+	// Quota of the API plan from the last response, -1 if unknown, accessed atomically
+	limit     int64
+	remaining int64
+	// Called once when the remaining quota reaches `minQuota`
+	minQuota  int64
+	exhausted func()
+	once      sync.Once
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.requests != nil {
+		if serr := t.requests.wait(req.Context(), 1); serr != nil {
+			return nil, serr
+		}
+	}
+	res, serr := t.next.RoundTrip(req)
+	if serr != nil {
+		return nil, serr
+	}
+	t.observeQuota(res.Header)
+	if t.bytes != nil {
+		res.Body = &rateLimitBody{ReadCloser: res.Body, ctx: req.Context(), bucket: t.bytes}
+	}
+	return res, nil
+}
+
+// observeQuota records the quota in the response headers if they exist.
+func (t *rateLimitTransport) observeQuota(header http.Header) {
+	if limit, serr := strconv.ParseInt(header.Get(headerRateLimitLimit), 10, 64); serr == nil {
+		atomic.StoreInt64(&t.limit, limit)
+	}
+	remaining, serr := strconv.ParseInt(header.Get(headerRateLimitRemaining), 10, 64)
+	if serr != nil {
+		return
+	}
+	atomic.StoreInt64(&t.remaining, remaining)
+	if t.exhausted != nil && remaining <= t.minQuota {
+		t.once.Do(t.exhausted)
+	}
+}
+
+// quota returns the remaining and the limit of the quota, -1 if unknown.
+func (t *rateLimitTransport) quota() (int64, int64) {
+	return atomic.LoadInt64(&t.remaining), atomic.LoadInt64(&t.limit)
+}
+
+// rateLimitBody waits for tokens of bytes while reading the body of a response.
+type rateLimitBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	bucket *tokenBucket
+}
+
+func (b *rateLimitBody) Read(p []byte) (int, error) {
+	// Read in pieces smaller than the burst so that reads are spread evenly
+	if len(p) > int(b.bucket.burst) {
+		p = p[:int(b.bucket.burst)]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if serr := b.bucket.wait(b.ctx, float64(n)); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return n, err
+}
+
+// newRateLimitTransport makes the transport limiting requests to `maxRPS` requests and `maxBytesPerSec` bytes per second.
+// Zero disables each of the limits. `exhausted` is called once when the remaining quota of the API plan reaches `minQuota`,
+// it is never called if `exhausted` is nil or the server does not return the quota.
+// Requests are sent through the transport given to wrap.
+func newRateLimitTransport(maxRPS float64, maxBytesPerSec int64, minQuota int64, exhausted func()) *rateLimitTransport {
+	t := new(rateLimitTransport)
+	t.limit = -1
+	t.remaining = -1
+	t.minQuota = minQuota
+	t.exhausted = exhausted
+	if maxRPS > 0 {
+		burst := maxRPS
+		if burst < 1 {
+			burst = 1
+		}
+		t.requests = newTokenBucket(maxRPS, burst)
+	}
+	if maxBytesPerSec > 0 {
+		// A second of bytes can be read at once
+		t.bytes = newTokenBucket(float64(maxBytesPerSec), float64(maxBytesPerSec))
+	}
+	return t
+}
+
+// wrap makes the transport send requests through `next` and returns it.
+func (t *rateLimitTransport) wrap(next http.RoundTripper) http.RoundTripper {
+	t.next = next
+	return t
+}
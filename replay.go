@@ -2,26 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
 	"time"
 
+	"github.com/exchangedataset/exd-cli/format"
+	"github.com/exchangedataset/exd-cli/rapid"
 	"github.com/exchangedataset/exdgo"
 )
 
-const (
-	fieldExchange  = "line_exchange"
-	fieldType      = "line_type"
-	fieldTimestamp = "line_timestamp"
-	fieldChannel   = "line_channel"
-)
-
-func makeReplayRequestParameter(optFilter *string, optStart *string, optEnd *string) (rrp exdgo.ReplayRequestParam, err error) {
+func makeReplayRequestParameter(optFilter *string, optStart *string, optEnd *string, optDuration *string) (rrp exdgo.ReplayRequestParam, err error) {
 	if *optFilter == "" {
 		err = errors.New("--filter must be specified")
 		return
@@ -34,27 +29,7 @@ func makeReplayRequestParameter(optFilter *string, optStart *string, optEnd *str
 	}
 	rrp.Filter = filter
 
-	if *optStart == "" {
-		err = errors.New("--start must be specified")
-		return
-	}
-	start, serr := convertDatetimeParam(*optStart)
-	if serr != nil {
-		err = fmt.Errorf("--start: %v", serr)
-		return
-	}
-	rrp.Start = start
-	if *optEnd == "" {
-		err = errors.New("--end must be specified")
-		return
-	}
-	end, serr := convertDatetimeParam(*optEnd)
-	if serr != nil {
-		err = fmt.Errorf("--end: %v", end)
-		return
-	}
-	rrp.End = end
-
+	rrp.Start, rrp.End, err = makeDatetimeRange(*optStart, *optEnd, *optDuration)
 	return
 }
 
@@ -62,12 +37,23 @@ func subCmdReplay(args []string) (err error) {
 	// Define command option/flags
 	flg := flag.NewFlagSet("replay", flag.ExitOnError)
 	optFilter := flg.String("filter", "", "JSON. Set names of target exchanges and its channels to filter-in.")
-	optStart := flg.String("start", "", "Datetime. Set a start datetime of the stream.")
-	optEnd := flg.String("end", "", "Datetime. Set a end datetime of the stream.")
-	optFormat := flg.String("format", "", "Optinal. String. Set the output format. 'json', 'csv' are supported. Default is 'json'.")
-	optFields := flg.String("fields", "", "Optional for 'json', required for 'csv'. Set the field to be included.")
+	optStart := flg.String("start", "", "Datetime. Set a start datetime of the stream. Unix time in nanoseconds, RFC3339, '2020-09-01', '2020-09-01 12:00', 'now', 'today' or 'yesterday' in UTC optionally followed by an offset such as 'now-1h'.")
+	optEnd := flg.String("end", "", "Datetime. Set a end datetime of the stream. Same formats as --start are accepted.")
+	optDuration := flg.String("duration", "", "Optional. Duration. Set the length of the stream instead of --end, such as '6h' or '2d'.")
+	optFormat := flg.String("format", "", "Optinal. String. Set the output format. 'json', 'csv', 'parquet' are supported. Default is 'json'.")
+	optOutput := flg.String("output", "", "Optional. String. Set the path to the file to write output to. {exchange}, {channel}, {date}, {hour}, {minute} and {index} in it are replaced to write to multiple files, {channel} is _none for lines without channels. Required for 'parquet'. Default is stdout.")
+	optRotateInterval := flg.Duration("rotate-interval", 0, "Optional. Duration. Switch files of --output every this duration of the line timestamp, such as 1h or 24h. Default is not to rotate by time.")
+	optRotateSize := flg.String("rotate-size", "", "Optional. String. Switch files of --output before exceeding this size before compression, such as 100MB. --output must contain {index}. Default is not to rotate by size.")
+	optCompress := flg.String("compress", "", "Optional. String. Compress output with 'gzip', 'zstd', 'lz4' or 'none'. Default is detected from the extension of --output such as '.gz'.")
+	optSink := flg.String("sink", "", "Optional. String. Write lines to the sink other than files instead of --output. 'sqlite:PATH' is supported if exd is built with cgo (CGO_ENABLED=1).")
+	optFields := flg.String("fields", "", "Optional for 'json', required for 'csv'. Set the field to be included. Columns can be renamed or computed such as 'price AS p,price*size AS notional,iso(line_timestamp)'.")
 	optProgress := flg.Bool("progress", false, "Optional. Show progress in stderr. Default is false.")
 	optOnlyMsg := flg.Bool("only-msg", false, "Optional. Print only message type lines. Default is false.")
+	optTimeFormat := flg.String("time-format", "", "Optional. String. Set the format of line_timestamp, 'unixns', 'unixms', 'unix', 'rfc3339nano' or a layout of Go such as '2006-01-02 15:04:05.000'. Not supported for 'parquet' and --sink. Default is nanoseconds as it is.")
+	optTimezone := flg.String("timezone", "", "Optional. String. Set the timezone of --time-format such as 'Asia/Tokyo' or 'Local'. Only for 'rfc3339nano' and layouts. Default is 'UTC'.")
+	optWhere := flg.String("where", "", "Optional. String. Output only lines the expression is true for, such as 'price > 10000 and side == \"Buy\"'. Default is all lines.")
+	optPace := flg.Float64("pace", 0, "Optional. Float. Output lines at the pace they were recorded multiplied by this, such as 1.0 for real-time. SIGUSR1 pauses and resumes. Default is as fast as possible.")
+	optMaxGap := flg.Duration("max-gap", 0, "Optional. Duration. Shorten gaps between lines longer than this when --pace is set, such as 10s. Default is not to shorten.")
 	// Parse command flag/options
 	err = flg.Parse(args)
 	if err != nil {
@@ -78,28 +64,68 @@ func subCmdReplay(args []string) (err error) {
 	if err != nil {
 		return
 	}
+	err = installTransport()
+	if err != nil {
+		return
+	}
 	// Load flags
-	var fields []string
-	if *optFields != "" {
-		fields = strings.Split(*optFields, ",")
-	} else if *optFormat == "csv" {
+	fields, err := parseFields(*optFields)
+	if err != nil {
+		return
+	}
+	if fields == nil && *optFormat == "csv" {
 		return errors.New("--fields must be set if 'csv' format is specified")
 	}
+	names := outputFieldNames(fields)
+	timeFormat, err := makeTimeFormat(*optTimeFormat, *optTimezone)
+	if err != nil {
+		return
+	}
+	if timeFormat != nil && (*optFormat == "parquet" || *optSink != "") {
+		// Typed outputs have their own types for timestamps
+		return errors.New("--time-format can not be set for 'parquet' format or --sink")
+	}
+	if *optSink != "" {
+		if *optOutput != "" || *optCompress != "" || *optRotateInterval != 0 || *optRotateSize != "" {
+			return errors.New("--output, --compress and --rotate-* can not be set with --sink")
+		}
+		if *optFormat != "" && *optFormat != "json" {
+			return errors.New("--format can not be set with --sink")
+		}
+	}
+	if *optPace < 0 {
+		return errors.New("--pace must not be negative")
+	}
+	if *optMaxGap < 0 {
+		return errors.New("--max-gap must not be negative")
+	}
+	if *optMaxGap != 0 && *optPace == 0 {
+		return errors.New("--max-gap can only be set with --pace")
+	}
+	var where *whereExpr
+	if *optWhere != "" {
+		where, err = parseWhere(*optWhere)
+		if err != nil {
+			return
+		}
+	}
 	progress := *optProgress
 	onlyMsg := *optOnlyMsg
-	var formatter Formatter
+	var formatter format.Formatter
 	switch *optFormat {
 	case "":
-		formatter = newFormatterJSON(fields)
+		formatter = newFormatterFields(format.NewJSON(names), fields, timeFormat)
 	case "json":
-		formatter = newFormatterJSON(fields)
+		formatter = newFormatterFields(format.NewJSON(names), fields, timeFormat)
 	case "csv":
-		formatter = newFormatterCSV(fields)
+		formatter = newFormatterFields(format.NewCSV(names), fields, timeFormat)
+	case "parquet":
+		// Parquet formatter needs definitions, it is created later
 	default:
 		return fmt.Errorf("--format: '%v' not supported", *optFormat)
 	}
 	// Setup FilterParam from flags/options
-	rrp, serr := makeReplayRequestParameter(optFilter, optStart, optEnd)
+	rrp, serr := makeReplayRequestParameter(optFilter, optStart, optEnd, optDuration)
 	if serr != nil {
 		err = serr
 		return
@@ -112,6 +138,56 @@ func subCmdReplay(args []string) (err error) {
 		}
 	}()
 	cp := makeClientParam()
+	// Types of columns are determined from definitions in snapshots
+	var defs format.Definitions
+	if formatter == nil || *optSink != "" {
+		c, serr := exdgo.CreateClient(cp)
+		if serr != nil {
+			err = serr
+			return
+		}
+		defs, _, err = rapid.DownloadSnapshots(context.Background(), c, rrp.Filter, rrp.Start)
+		if err != nil {
+			return
+		}
+		// Types of computed columns are determined from the fields they are computed from
+		defs = projectFieldDefinitions(defs, fields)
+	}
+	if formatter == nil {
+		if names == nil {
+			names = []string{format.FieldExchange, format.FieldType, format.FieldTimestamp, format.FieldChannel}
+			names = append(names, defs.Keys()...)
+		}
+		formatter, err = format.NewParquet(names, defs)
+		if err != nil {
+			return
+		}
+		formatter = newFormatterFields(formatter, fields, timeFormat)
+	}
+	var sink format.Sink
+	if *optSink != "" {
+		sink, err = newSinkOf(*optSink, false, defs)
+	} else {
+		var rotation sinkRotation
+		rotation, err = makeSinkRotation(*optRotateInterval, *optRotateSize)
+		if err != nil {
+			return
+		}
+		sink, err = newSink(*optOutput, nil, formatter, rotation, *optCompress)
+	}
+	if err != nil {
+		return
+	}
+	defer func() {
+		serr := sink.Close()
+		if serr != nil {
+			if err != nil {
+				err = fmt.Errorf("%v, originally: %v", serr, err)
+			} else {
+				err = serr
+			}
+		}
+	}()
 	// Get a request instance
 	req, err := exdgo.Replay(cp, rrp)
 	if err != nil {
@@ -133,10 +209,21 @@ func subCmdReplay(args []string) (err error) {
 			}
 		}
 	}()
+	var pacer *replayPacer
+	if *optPace > 0 {
+		toggle := make(chan os.Signal, 1)
+		if len(pauseSignals) > 0 {
+			signal.Notify(toggle, pauseSignals...)
+			defer signal.Stop(toggle)
+		}
+		pacer = newReplayPacer(*optPace, *optMaxGap, rrp.Start.UnixNano(), toggle)
+	}
 	// Print loop
 	// Buffer to store a line before output
 	bufSlice := make([]byte, 0, 100000)
 	buf := bytes.NewBuffer(bufSlice)
+	// Minute of the last line, the sink is flushed when it changes
+	var lastMinute int64
 	// Used for showing progress
 	startTime := time.Now()
 	lastProgTime := startTime
@@ -157,19 +244,41 @@ func subCmdReplay(args []string) (err error) {
 		} else {
 			values = make(map[string]interface{})
 		}
-		values[fieldExchange] = line.Exchange
-		values[fieldType] = line.Type
-		timestamp := strconv.FormatInt(line.Timestamp, 10)
-		values[fieldTimestamp] = timestamp
+		values[format.FieldExchange] = line.Exchange
+		values[format.FieldType] = line.Type
+		// The same type as rapid, --time-format converts it into other formats
+		values[format.FieldTimestamp] = line.Timestamp
 		// Channel might not be present
+		var channel string
 		if line.Channel != nil {
-			values[fieldChannel] = *line.Channel
+			channel = *line.Channel
+			values[format.FieldChannel] = channel
+		}
+		if where != nil && !where.match(values) {
+			continue
+		}
+		if pacer != nil {
+			err = pacer.wait(context.Background(), line.Timestamp)
+			if err != nil {
+				return
+			}
+		}
+		if minute := line.Timestamp / int64(time.Minute); minute != lastMinute {
+			err = sink.Flush()
+			if err != nil {
+				return
+			}
+			lastMinute = minute
 		}
 		err = formatter.WriteTo(buf, values)
 		if err != nil {
 			return
 		}
-		_, err = os.Stdout.Write(buf.Bytes())
+		err = sink.Route(line.Exchange, channel, line.Timestamp)
+		if err != nil {
+			return
+		}
+		_, err = sink.Write(buf.Bytes())
 		if err != nil {
 			return
 		}
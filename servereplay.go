@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/exchangedataset/exd-cli/format"
+	"github.com/exchangedataset/exdgo"
+	"github.com/gorilla/websocket"
+)
+
+// Number of minutes the stream of each connection buffers
+const serveReplayBufferSize = 20
+
+// replayServer streams lines to WebSocket clients as if it is the server of exchanges.
+// Each connection starts its own replay from the start.
+type replayServer struct {
+	cp  exdgo.ClientParam
+	rrp exdgo.ReplayRequestParam
+	// 'raw' to send messages as exchanges sent, 'json' to send lines formatted in JSON
+	format   string
+	speed    float64
+	upgrader websocket.Upgrader
+}
+
+func (s *replayServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Path is '/' for all exchanges in the filter, or '/EXCHANGE' for one of them
+	filter := s.rrp.Filter
+	if exchange := strings.Trim(req.URL.Path, "/"); exchange != "" {
+		channels, ok := s.rrp.Filter[exchange]
+		if !ok {
+			http.Error(w, fmt.Sprintf("'%s' is not in --filter", exchange), http.StatusNotFound)
+			return
+		}
+		filter = map[string][]string{exchange: channels}
+	}
+	conn, serr := s.upgrader.Upgrade(w, req, nil)
+	if serr != nil {
+		// Upgrade has already responded with the error
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(os.Stderr, "%s: connected to %s\n", req.RemoteAddr, req.URL.Path)
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	// Messages from the client such as subscriptions are ignored, but they have to be read to handle control messages
+	go func() {
+		defer cancel()
+		for {
+			if _, _, serr := conn.ReadMessage(); serr != nil {
+				return
+			}
+		}
+	}()
+	serr = s.stream(ctx, conn, filter)
+	if serr != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", req.RemoteAddr, serr)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s: replay completed\n", req.RemoteAddr)
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "replay completed"))
+}
+
+// stream sends message lines of the filter to the connection.
+func (s *replayServer) stream(ctx context.Context, conn *websocket.Conn, filter map[string][]string) (err error) {
+	pacer := newReplayPacer(s.speed, 0, s.rrp.Start.UnixNano(), nil)
+	if s.format == "json" {
+		return s.streamJSON(ctx, conn, filter, pacer)
+	}
+	format := "raw"
+	req, err := exdgo.Raw(s.cp, exdgo.RawRequestParam{
+		Filter: filter,
+		Start:  s.rrp.Start,
+		End:    s.rrp.End,
+		Format: &format,
+	})
+	if err != nil {
+		return
+	}
+	itr, err := req.StreamWithContext(ctx, serveReplayBufferSize)
+	if err != nil {
+		return
+	}
+	defer func() {
+		serr := itr.Close()
+		if serr != nil && err == nil {
+			err = serr
+		}
+	}()
+	for {
+		line, ok, serr := itr.Next()
+		if !ok {
+			return serr
+		}
+		if line.Type != exdgo.LineTypeMessage {
+			continue
+		}
+		if err = pacer.wait(ctx, line.Timestamp); err != nil {
+			return
+		}
+		if err = conn.WriteMessage(websocket.TextMessage, bytes.TrimSuffix(line.Message, []byte{'\n'})); err != nil {
+			return
+		}
+	}
+}
+
+// streamJSON sends message lines formatted in JSON in the same way as `replay`.
+func (s *replayServer) streamJSON(ctx context.Context, conn *websocket.Conn, filter map[string][]string, pacer *replayPacer) (err error) {
+	rrp := s.rrp
+	rrp.Filter = filter
+	req, err := exdgo.Replay(s.cp, rrp)
+	if err != nil {
+		return
+	}
+	itr, err := req.StreamWithContext(ctx, serveReplayBufferSize)
+	if err != nil {
+		return
+	}
+	defer func() {
+		serr := itr.Close()
+		if serr != nil && err == nil {
+			err = serr
+		}
+	}()
+	formatter := format.NewJSON(nil)
+	buf := new(bytes.Buffer)
+	for {
+		line, ok, serr := itr.Next()
+		if !ok {
+			return serr
+		}
+		if line.Type != exdgo.LineTypeMessage {
+			continue
+		}
+		values := line.Message.(map[string]interface{})
+		values[format.FieldExchange] = line.Exchange
+		values[format.FieldType] = line.Type
+		values[format.FieldTimestamp] = strconv.FormatInt(line.Timestamp, 10)
+		values[format.FieldChannel] = *line.Channel
+		if err = formatter.WriteTo(buf, values); err != nil {
+			return
+		}
+		if err = pacer.wait(ctx, line.Timestamp); err != nil {
+			return
+		}
+		// Remove the trailing new line
+		if err = conn.WriteMessage(websocket.TextMessage, bytes.TrimSuffix(buf.Bytes(), []byte{'\n'})); err != nil {
+			return
+		}
+		buf.Reset()
+	}
+}
+
+func subCmdServeReplay(args []string) (err error) {
+	flg := flag.NewFlagSet("serve-replay", flag.ExitOnError)
+	optFilter := flg.String("filter", "", "JSON. Set names of target exchanges and its channels to stream.")
+	optStart := flg.String("start", "", "Datetime. Set a start datetime of the stream. Unix time in nanoseconds, RFC3339, '2020-09-01', '2020-09-01 12:00', 'now', 'today' or 'yesterday' in UTC optionally followed by an offset such as 'now-1h'.")
+	optEnd := flg.String("end", "", "Datetime. Set a end datetime of the stream. Same formats as --start are accepted.")
+	optDuration := flg.String("duration", "", "Optional. Duration. Set the length of the stream instead of --end, such as '6h' or '2d'.")
+	optAddr := flg.String("addr", "127.0.0.1:8081", "Optional. String. Set the address to listen on. Default is '127.0.0.1:8081'.")
+	optSpeed := flg.Float64("speed", 1, "Optional. Float. Set the speed multiplier of the replay, such as 10 for 10x. 0 sends lines as fast as possible. Default is 1.")
+	optFormat := flg.String("format", "raw", "Optional. String. 'raw' sends messages as exchanges sent, 'json' sends lines in the same JSON format as replay. Default is 'raw'.")
+	flg.Usage = func() {
+		fmt.Fprintln(flg.Output(), "Usage of serve-replay:")
+		fmt.Fprintln(flg.Output(), "Streams historical messages over WebSocket as if it is the server of exchanges.")
+		fmt.Fprintln(flg.Output(), "Connect to 'ws://ADDR/EXCHANGE' for messages of an exchange, or 'ws://ADDR/' for all exchanges in --filter.")
+		fmt.Fprintln(flg.Output(), "Each connection replays from --start, messages sent by clients are ignored.")
+		flg.PrintDefaults()
+	}
+	err = flg.Parse(args)
+	if err != nil {
+		return
+	}
+	// Load config
+	err = initConfig()
+	if err != nil {
+		return
+	}
+	err = installTransport()
+	if err != nil {
+		return
+	}
+	if *optSpeed < 0 {
+		return errors.New("--speed must not be negative")
+	}
+	if *optFormat != "raw" && *optFormat != "json" {
+		return fmt.Errorf("--format: '%v' not supported", *optFormat)
+	}
+	rrp, err := makeReplayRequestParameter(optFilter, optStart, optEnd, optDuration)
+	if err != nil {
+		return
+	}
+	s := &replayServer{
+		cp:     makeClientParam(),
+		rrp:    rrp,
+		format: *optFormat,
+		speed:  *optSpeed,
+		upgrader: websocket.Upgrader{
+			// Clients are local bots, not browsers
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+	fmt.Fprintf(os.Stderr, "Listening on ws://%s/\n", *optAddr)
+	err = http.ListenAndServe(*optAddr, s)
+	if err != nil {
+		err = fmt.Errorf("serve-replay: %v", err)
+	}
+	return
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Exit code of the process stopped by SIGINT or SIGTERM, following the convention of shells for SIGINT
+const exitCodeInterrupted = 130
+
+// errInterrupted is returned from subcommands stopped by SIGINT or SIGTERM.
+var errInterrupted = errors.New("interrupted")
+
+// errQuotaExhausted is returned from subcommands stopped as the remaining quota of the API plan reached the limit.
+var errQuotaExhausted = errors.New("stopped as the remaining quota reached --min-quota")
+
+// withShutdownSignals returns the context which is cancelled when SIGINT or SIGTERM is received.
+// Only the first signal is handled, another one terminates the process immediately as usual.
+func withShutdownSignals(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case s := <-sig:
+			fmt.Fprintf(os.Stderr, "\nReceived %v, stopping after the current minute. Send it again to terminate immediately\n", s)
+		case <-ctx.Done():
+		}
+		signal.Stop(sig)
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// exitCodeOf returns the exit code of the process for the error returned from a subcommand.
+func exitCodeOf(err error) int {
+	if errors.Is(err, errInterrupted) {
+		return exitCodeInterrupted
+	}
+	return 1
+}
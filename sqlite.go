@@ -0,0 +1,381 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	// Registers the driver for SQLite
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/exchangedataset/exd-cli/format"
+)
+
+const (
+	sqliteTypeInteger = "INTEGER"
+	sqliteTypeReal    = "REAL"
+	sqliteTypeText    = "TEXT"
+	// Table which maps exchanges and channels to the names of their tables
+	sqliteTablesTable = "_exd_tables"
+)
+
+// Types of the special fields
+var sqliteLineFieldTypes = map[string]string{
+	format.FieldExchange:  sqliteTypeText,
+	format.FieldType:      sqliteTypeText,
+	format.FieldTimestamp: sqliteTypeInteger,
+	format.FieldChannel:   sqliteTypeText,
+}
+
+// sqliteTypeOf returns the column type for the type in a channel definition.
+func sqliteTypeOf(defType string) string {
+	switch defType {
+	case "int", "timestamp", "duration", "boolean", "bool":
+		return sqliteTypeInteger
+	case "float":
+		return sqliteTypeReal
+	default:
+		return sqliteTypeText
+	}
+}
+
+// quoteSQLite quotes an identifier such as a table name.
+func quoteSQLite(name string) string {
+	return "\"" + strings.Replace(name, "\"", "\"\"", -1) + "\""
+}
+
+// convertSQLiteValue converts a value decoded from a JSON line into the type of the column.
+func convertSQLiteValue(typ string, value interface{}) (interface{}, error) {
+	switch value.(type) {
+	case nil:
+		return nil, nil
+	case json.Number:
+		number := value.(json.Number)
+		switch typ {
+		case sqliteTypeInteger:
+			if i, serr := number.Int64(); serr == nil {
+				return i, nil
+			}
+			return number.Float64()
+		case sqliteTypeReal:
+			return number.Float64()
+		default:
+			return number.String(), nil
+		}
+	case string:
+		str := value.(string)
+		switch typ {
+		case sqliteTypeInteger:
+			return strconv.ParseInt(str, 10, 64)
+		case sqliteTypeReal:
+			return strconv.ParseFloat(str, 64)
+		default:
+			return str, nil
+		}
+	case bool:
+		if value.(bool) {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	default:
+		// Objects and arrays are stored as JSON strings
+		marshaled, serr := json.Marshal(value)
+		if serr != nil {
+			return nil, serr
+		}
+		return string(marshaled), nil
+	}
+}
+
+// sqliteTable is a table for lines of an exchange and a channel.
+type sqliteTable struct {
+	name     string
+	exchange string
+	channel  string
+	// Types of columns
+	columns map[string]string
+	// Columns in the order of creation
+	order []string
+	// Insert statement prepared in the current transaction, nil if not yet prepared
+	insert *sql.Stmt
+}
+
+// sinkSQLite is the sink which inserts lines formatted in JSON into SQLite tables.
+// A table is made for each pair of an exchange and a channel, lines are inserted in a transaction for each chunk.
+// It needs cgo, see sqlite_nocgo.go.
+type sinkSQLite struct {
+	db         *sql.DB
+	tx         *sql.Tx
+	defs       format.Definitions
+	appendFile bool
+	// Tables by exchange and channel joined with tab
+	tables  map[string]*sqliteTable
+	current *sqliteTable
+}
+
+// begin begins a transaction if it has not yet begun.
+func (s *sinkSQLite) begin() error {
+	if s.tx != nil {
+		return nil
+	}
+	tx, serr := s.db.Begin()
+	if serr != nil {
+		return serr
+	}
+	s.tx = tx
+	return nil
+}
+
+// columnType returns the column type for the field of the table.
+func (s *sinkSQLite) columnType(t *sqliteTable, field string) string {
+	if typ, ok := sqliteLineFieldTypes[field]; ok {
+		return typ
+	}
+	if defType, ok := s.defs[t.exchange][t.channel][field]; ok {
+		return sqliteTypeOf(defType)
+	}
+	return sqliteTypeText
+}
+
+// tableName returns the name of the table for the exchange and the channel.
+// Names are such as "bitmex_trade", and are recorded in the mapping table so that
+// pairs which make the same name such as ("a_b", "c") and ("a", "b_c") have different tables.
+func (s *sinkSQLite) tableName(exchange string, channel string) (string, error) {
+	var name string
+	serr := s.tx.QueryRow("SELECT name FROM "+quoteSQLite(sqliteTablesTable)+" WHERE exchange = ? AND channel = ?", exchange, channel).Scan(&name)
+	if serr == nil {
+		return name, nil
+	} else if serr != sql.ErrNoRows {
+		return "", serr
+	}
+	base := exchange
+	if channel != "" {
+		base += "_" + channel
+	}
+	name = base
+	for i := 2; ; i++ {
+		var count int
+		serr := s.tx.QueryRow("SELECT COUNT(*) FROM "+quoteSQLite(sqliteTablesTable)+" WHERE name = ?", name).Scan(&count)
+		if serr != nil {
+			return "", serr
+		}
+		if count == 0 {
+			break
+		}
+		name = base + "_" + strconv.Itoa(i)
+	}
+	_, serr = s.tx.Exec("INSERT INTO "+quoteSQLite(sqliteTablesTable)+" (name, exchange, channel) VALUES (?, ?, ?)", name, exchange, channel)
+	if serr != nil {
+		return "", serr
+	}
+	return name, nil
+}
+
+// createTable creates the table for the exchange and the channel if it does not exist.
+// An existing table is dropped if the sink is not appending.
+func (s *sinkSQLite) createTable(exchange string, channel string) (*sqliteTable, error) {
+	name, serr := s.tableName(exchange, channel)
+	if serr != nil {
+		return nil, serr
+	}
+	t := &sqliteTable{
+		name:     name,
+		exchange: exchange,
+		channel:  channel,
+		columns:  make(map[string]string),
+	}
+	if !s.appendFile {
+		if _, serr := s.tx.Exec("DROP TABLE IF EXISTS " + quoteSQLite(t.name)); serr != nil {
+			return nil, serr
+		}
+	}
+	// Columns for lines and fields in the definition
+	fields := []string{format.FieldExchange, format.FieldType, format.FieldTimestamp, format.FieldChannel}
+	defFields := make([]string, 0, len(s.defs[exchange][channel]))
+	for field := range s.defs[exchange][channel] {
+		if _, ok := sqliteLineFieldTypes[field]; !ok {
+			defFields = append(defFields, field)
+		}
+	}
+	sort.Strings(defFields)
+	fields = append(fields, defFields...)
+	decls := make([]string, len(fields))
+	for i, field := range fields {
+		decls[i] = quoteSQLite(field) + " " + s.columnType(t, field)
+	}
+	_, serr = s.tx.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", quoteSQLite(t.name), strings.Join(decls, ", ")))
+	if serr != nil {
+		return nil, serr
+	}
+	_, serr = s.tx.Exec(fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (%s)", quoteSQLite(t.name+"_"+format.FieldTimestamp), quoteSQLite(t.name), quoteSQLite(format.FieldTimestamp)))
+	if serr != nil {
+		return nil, serr
+	}
+	// The existing table could have more columns
+	rows, serr := s.tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", quoteSQLite(t.name)))
+	if serr != nil {
+		return nil, serr
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid int
+		var name, typ string
+		var notNull int
+		var defaultValue interface{}
+		var pk int
+		if serr := rows.Scan(&cid, &name, &typ, &notNull, &defaultValue, &pk); serr != nil {
+			return nil, serr
+		}
+		t.columns[name] = typ
+		t.order = append(t.order, name)
+	}
+	return t, rows.Err()
+}
+
+func (s *sinkSQLite) Route(exchange string, channel string, timestamp int64) error {
+	key := exchange + "\t" + channel
+	if t, ok := s.tables[key]; ok {
+		s.current = t
+		return nil
+	}
+	if serr := s.begin(); serr != nil {
+		return fmt.Errorf("sqlite Route: %v", serr)
+	}
+	t, serr := s.createTable(exchange, channel)
+	if serr != nil {
+		return fmt.Errorf("sqlite Route: '%s' '%s': %v", exchange, channel, serr)
+	}
+	s.tables[key] = t
+	s.current = t
+	return nil
+}
+
+// insert inserts a row into the current table, adding columns if needed.
+func (s *sinkSQLite) insert(row map[string]interface{}) error {
+	t := s.current
+	for field, value := range row {
+		if _, ok := t.columns[field]; ok || value == nil {
+			continue
+		}
+		// A field not in the definition
+		typ := s.columnType(t, field)
+		if _, serr := s.tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", quoteSQLite(t.name), quoteSQLite(field), typ)); serr != nil {
+			return serr
+		}
+		t.columns[field] = typ
+		t.order = append(t.order, field)
+		if t.insert != nil {
+			t.insert.Close()
+			t.insert = nil
+		}
+	}
+	if t.insert == nil {
+		columns := make([]string, len(t.order))
+		for i, column := range t.order {
+			columns[i] = quoteSQLite(column)
+		}
+		placeholders := strings.Repeat(", ?", len(t.order))[2:]
+		stmt, serr := s.tx.Prepare(fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteSQLite(t.name), strings.Join(columns, ", "), placeholders))
+		if serr != nil {
+			return serr
+		}
+		t.insert = stmt
+	}
+	args := make([]interface{}, len(t.order))
+	for i, column := range t.order {
+		converted, serr := convertSQLiteValue(t.columns[column], row[column])
+		if serr != nil {
+			return fmt.Errorf("%s: %v", column, serr)
+		}
+		args[i] = converted
+	}
+	_, serr := t.insert.Exec(args...)
+	return serr
+}
+
+func (s *sinkSQLite) Write(p []byte) (int, error) {
+	if s.current == nil {
+		return 0, errors.New("sqlite Write: lines are written without a route")
+	}
+	if serr := s.begin(); serr != nil {
+		return 0, fmt.Errorf("sqlite Write: %v", serr)
+	}
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.UseNumber()
+	for dec.More() {
+		row := make(map[string]interface{})
+		if serr := dec.Decode(&row); serr != nil {
+			return 0, fmt.Errorf("sqlite Write: %v", serr)
+		}
+		if serr := s.insert(row); serr != nil {
+			return 0, fmt.Errorf("sqlite Write: %s: %v", s.current.name, serr)
+		}
+	}
+	return len(p), nil
+}
+
+func (s *sinkSQLite) Flush() error {
+	if s.tx == nil {
+		return nil
+	}
+	// Statements are closed with the transaction
+	for _, t := range s.tables {
+		t.insert = nil
+	}
+	serr := s.tx.Commit()
+	s.tx = nil
+	if serr != nil {
+		return fmt.Errorf("sqlite Flush: %v", serr)
+	}
+	return nil
+}
+
+// Offsets returns no files, lines are committed in a transaction for each chunk
+// and those written after a checkpoint are rolled back on a crash.
+func (s *sinkSQLite) Offsets() (map[string]int64, error) {
+	return map[string]int64{}, nil
+}
+
+func (s *sinkSQLite) Close() error {
+	serr := s.Flush()
+	if cerr := s.db.Close(); serr == nil && cerr != nil {
+		serr = fmt.Errorf("sqlite Close: %v", cerr)
+	}
+	return serr
+}
+
+// newSQLiteSink opens the SQLite database at `path` and returns the sink which inserts lines formatted in JSON.
+// Types of columns are determined from definitions of channels.
+// Existing tables for the lines are dropped unless `appendFile` is true.
+func newSQLiteSink(path string, appendFile bool, defs format.Definitions) (format.Sink, error) {
+	db, serr := sql.Open("sqlite3", path)
+	if serr != nil {
+		return nil, fmt.Errorf("newSQLiteSink: %v", serr)
+	}
+	// Check if the database can be opened
+	if serr := db.Ping(); serr != nil {
+		db.Close()
+		return nil, fmt.Errorf("newSQLiteSink: %v", serr)
+	}
+	// A transaction holds a connection
+	db.SetMaxOpenConns(1)
+	_, serr = db.Exec("CREATE TABLE IF NOT EXISTS " + quoteSQLite(sqliteTablesTable) + " (name TEXT NOT NULL UNIQUE, exchange TEXT NOT NULL, channel TEXT NOT NULL, PRIMARY KEY (exchange, channel))")
+	if serr != nil {
+		db.Close()
+		return nil, fmt.Errorf("newSQLiteSink: %v", serr)
+	}
+	s := new(sinkSQLite)
+	s.db = db
+	s.defs = defs
+	s.appendFile = appendFile
+	s.tables = make(map[string]*sqliteTable)
+	return s, nil
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+// +build !cgo
+
+package main
+
+import (
+	"errors"
+
+	"github.com/exchangedataset/exd-cli/format"
+)
+
+// newSQLiteSink fails since the driver for SQLite needs cgo.
+func newSQLiteSink(path string, appendFile bool, defs format.Definitions) (format.Sink, error) {
+	return nil, errors.New("--sink: 'sqlite' is not supported by this build of exd, build it with CGO_ENABLED=1")
+}
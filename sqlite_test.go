@@ -0,0 +1,74 @@
+//go:build cgo
+// +build cgo
+
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/exchangedataset/exd-cli/format"
+)
+
+// TestSQLiteTableNames checks that pairs of exchanges and channels which make the same name have different tables.
+func TestSQLiteTableNames(t *testing.T) {
+	dir, serr := ioutil.TempDir("", "exd-test-*")
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lines.db")
+	defs := format.Definitions{
+		"a_b": {"c": {"price": "float"}},
+		"a":   {"b_c": {"price": "float"}},
+	}
+	lines := []struct {
+		exchange string
+		channel  string
+		line     string
+	}{
+		{"a_b", "c", `{"line_exchange":"a_b","line_channel":"c","price":1}` + "\n"},
+		{"a", "b_c", `{"line_exchange":"a","line_channel":"b_c","price":2}` + "\n"},
+		{"a_b", "c", `{"line_exchange":"a_b","line_channel":"c","price":3}` + "\n"},
+	}
+	// Tables are found again when appended
+	for _, appendFile := range []bool{false, true} {
+		sink, serr := newSQLiteSink(path, appendFile, defs)
+		if serr != nil {
+			t.Fatal(serr)
+		}
+		for _, l := range lines {
+			if serr := sink.Route(l.exchange, l.channel, 0); serr != nil {
+				t.Fatal(serr)
+			}
+			if _, serr := sink.Write([]byte(l.line)); serr != nil {
+				t.Fatal(serr)
+			}
+		}
+		if serr := sink.Close(); serr != nil {
+			t.Fatal(serr)
+		}
+	}
+	db, serr := sql.Open("sqlite3", path)
+	if serr != nil {
+		t.Fatal(serr)
+	}
+	defer db.Close()
+	want := map[string]float64{"a_b": 8, "a": 4}
+	for exchange, sum := range want {
+		var name string
+		if serr := db.QueryRow("SELECT name FROM _exd_tables WHERE exchange = ?", exchange).Scan(&name); serr != nil {
+			t.Fatal(serr)
+		}
+		var got float64
+		if serr := db.QueryRow("SELECT SUM(price) FROM " + quoteSQLite(name)).Scan(&got); serr != nil {
+			t.Fatal(serr)
+		}
+		if got != sum {
+			t.Errorf("sum of prices in %s for '%s' = %v, want %v", name, exchange, got, sum)
+		}
+	}
+}
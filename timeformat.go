@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Formats of `line_timestamp` given by the `--time-format` option, other formats are regarded as layouts of the time package
+const (
+	timeFormatUnixNano    = "unixns"
+	timeFormatUnixMilli   = "unixms"
+	timeFormatUnix        = "unix"
+	timeFormatRFC3339Nano = "rfc3339nano"
+)
+
+// timeFormat converts timestamps in nanoseconds into the format given by the `--time-format` option.
+type timeFormat struct {
+	name string
+	// Layout of the time package, empty if timestamps are converted into numbers
+	layout   string
+	location *time.Location
+}
+
+// format returns `timestamp` in the format.
+func (tf *timeFormat) format(timestamp int64) interface{} {
+	switch tf.name {
+	case timeFormatUnixNano:
+		return timestamp
+	case timeFormatUnixMilli:
+		return timestamp / int64(time.Millisecond)
+	case timeFormatUnix:
+		return timestamp / int64(time.Second)
+	default:
+		return time.Unix(0, timestamp).In(tf.location).Format(tf.layout)
+	}
+}
+
+// makeTimeFormat makes timeFormat from the `--time-format` and `--timezone` options, nil if `format` is empty.
+func makeTimeFormat(format string, timezone string) (*timeFormat, error) {
+	if format == "" {
+		if timezone != "" {
+			return nil, errors.New("--timezone can only be set with --time-format")
+		}
+		return nil, nil
+	}
+	tf := &timeFormat{name: format, location: time.UTC}
+	switch format {
+	case timeFormatUnixNano, timeFormatUnixMilli, timeFormatUnix:
+		if timezone != "" {
+			return nil, fmt.Errorf("--timezone can not be set with '%s'", format)
+		}
+		return tf, nil
+	case timeFormatRFC3339Nano:
+		tf.layout = time.RFC3339Nano
+	default:
+		// A layout without any elements would output the same string for every line
+		if time.Unix(0, 0).Format(format) == format {
+			return nil, fmt.Errorf("--time-format: '%s' is neither a supported format nor a layout", format)
+		}
+		tf.layout = format
+	}
+	if timezone != "" {
+		location, serr := time.LoadLocation(timezone)
+		if serr != nil {
+			return nil, fmt.Errorf("--timezone: %v", serr)
+		}
+		tf.location = location
+	}
+	return tf, nil
+}
@@ -0,0 +1,842 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/exchangedataset/exd-cli/format"
+	"github.com/exchangedataset/exdgo"
+)
+
+// The `--where` option is an expression evaluated against the values of a line, lines are output only if it is true.
+//
+//	size >= 100 and pair == "XBTUSD"
+//	side in ("Buy", "Sell") or not (price * size < 1e6)
+//	pair =~ "^XBT" and line_timestamp % 1000000000 == 0
+//
+// Fields are referred by names, `backquotes` can be used for names with other characters.
+// Missing fields are null, and comparisons with null other than == and != are false.
+// Strings are converted to numbers when they are compared or calculated with numbers.
+// Expressions are also used to compute columns in the `--fields` option, see fields.go.
+
+// whereTokenKind is the kind of a token of `--where` expressions.
+type whereTokenKind int
+
+const (
+	whereTokenEOF = whereTokenKind(iota)
+	whereTokenNumber
+	whereTokenString
+	whereTokenIdent
+	// Field names quoted with backquotes, which are never keywords
+	whereTokenQuotedIdent
+	whereTokenOperator
+)
+
+type whereToken struct {
+	kind whereTokenKind
+	text string
+	// Position in the source used for error messages
+	pos int
+}
+
+// Operators in the order of matching, longer ones first
+var whereOperators = []string{"==", "!=", "<=", ">=", "=~", "!~", "&&", "||", "<", ">", "+", "-", "*", "/", "%", "(", ")", "[", "]", ",", "!", "="}
+
+// tokenizeWhere splits the expression into tokens.
+// Names are read by runes so that they can contain letters other than ASCII.
+func tokenizeWhere(src string) ([]whereToken, error) {
+	var tokens []whereToken
+	for i := 0; i < len(src); {
+		c, size := utf8.DecodeRuneInString(src[i:])
+		switch {
+		case c == utf8.RuneError && size == 1:
+			return nil, fmt.Errorf("position %d: invalid UTF-8", i)
+		case unicode.IsSpace(c):
+			i += size
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(src) && src[i+1] >= '0' && src[i+1] <= '9':
+			start := i
+			for i < len(src) && (strings.IndexByte("0123456789.eE", src[i]) >= 0 || (src[i] == '-' || src[i] == '+') && (src[i-1] == 'e' || src[i-1] == 'E')) {
+				i++
+			}
+			tokens = append(tokens, whereToken{whereTokenNumber, src[start:i], start})
+		case c == '"' || c == '\'':
+			start := i
+			var sb strings.Builder
+			for i++; ; i++ {
+				if i >= len(src) {
+					return nil, fmt.Errorf("position %d: unterminated string", start)
+				}
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+					switch src[i] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(src[i])
+					}
+					continue
+				}
+				if rune(src[i]) == c {
+					i++
+					break
+				}
+				sb.WriteByte(src[i])
+			}
+			tokens = append(tokens, whereToken{whereTokenString, sb.String(), start})
+		case c == '`':
+			end := strings.IndexByte(src[i+1:], '`')
+			if end < 0 {
+				return nil, fmt.Errorf("position %d: unterminated field name", i)
+			}
+			tokens = append(tokens, whereToken{whereTokenQuotedIdent, src[i+1 : i+1+end], i})
+			i += end + 2
+		case c == '_' || unicode.IsLetter(c):
+			start := i
+			for i < len(src) {
+				r, size := utf8.DecodeRuneInString(src[i:])
+				if r != '_' && r != '.' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+					break
+				}
+				i += size
+			}
+			tokens = append(tokens, whereToken{whereTokenIdent, src[start:i], start})
+		default:
+			matched := false
+			for _, op := range whereOperators {
+				if strings.HasPrefix(src[i:], op) {
+					tokens = append(tokens, whereToken{whereTokenOperator, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("position %d: unexpected character '%c'", i, c)
+			}
+		}
+	}
+	return append(tokens, whereToken{whereTokenEOF, "", len(src)}), nil
+}
+
+// whereNode is a node of the syntax tree of `--where` expressions.
+// Nodes must not be modified in eval since they are evaluated concurrently.
+type whereNode interface {
+	eval(values map[string]interface{}) interface{}
+	// typeOf returns the type of the result in the same notation as channel definitions, such as 'int'.
+	typeOf(def map[string]string) string
+}
+
+// whereFunction is a function which can be called in expressions such as `iso(line_timestamp)`.
+type whereFunction struct {
+	call func(arg interface{}) interface{}
+	// Type of the result
+	typ string
+}
+
+var whereFunctions = map[string]whereFunction{
+	// RFC3339 datetime in UTC of a timestamp in nanoseconds
+	"iso": {call: whereISO, typ: "string"},
+	// Milliseconds of a timestamp in nanoseconds
+	"ms": {call: whereMilliseconds, typ: "int"},
+}
+
+func whereISO(arg interface{}) interface{} {
+	switch v := whereNumber(arg).(type) {
+	case int64:
+		return time.Unix(0, v).UTC().Format(time.RFC3339Nano)
+	case float64:
+		return time.Unix(0, int64(v)).UTC().Format(time.RFC3339Nano)
+	}
+	return nil
+}
+
+func whereMilliseconds(arg interface{}) interface{} {
+	switch v := whereNumber(arg).(type) {
+	case int64:
+		return v / int64(time.Millisecond)
+	case float64:
+		return int64(v) / int64(time.Millisecond)
+	}
+	return nil
+}
+
+type whereLiteral struct {
+	value interface{}
+}
+
+func (n *whereLiteral) eval(values map[string]interface{}) interface{} {
+	return n.value
+}
+
+func (n *whereLiteral) typeOf(def map[string]string) string {
+	switch n.value.(type) {
+	case int64:
+		return "int"
+	case float64:
+		return "float"
+	case bool:
+		return "boolean"
+	default:
+		return "string"
+	}
+}
+
+type whereField struct {
+	name string
+}
+
+func (n *whereField) eval(values map[string]interface{}) interface{} {
+	value := values[n.name]
+	if lt, ok := value.(exdgo.LineType); ok {
+		return string(lt)
+	}
+	return value
+}
+
+func (n *whereField) typeOf(def map[string]string) string {
+	if n.name == format.FieldTimestamp {
+		return "timestamp"
+	}
+	if typ, ok := def[n.name]; ok {
+		return typ
+	}
+	return "string"
+}
+
+type whereCall struct {
+	name string
+	arg  whereNode
+}
+
+func (n *whereCall) eval(values map[string]interface{}) interface{} {
+	return whereFunctions[n.name].call(n.arg.eval(values))
+}
+
+func (n *whereCall) typeOf(def map[string]string) string {
+	return whereFunctions[n.name].typ
+}
+
+type whereNot struct {
+	operand whereNode
+}
+
+func (n *whereNot) eval(values map[string]interface{}) interface{} {
+	return !whereTruthy(n.operand.eval(values))
+}
+
+func (n *whereNot) typeOf(def map[string]string) string {
+	return "boolean"
+}
+
+type whereNegate struct {
+	operand whereNode
+}
+
+func (n *whereNegate) eval(values map[string]interface{}) interface{} {
+	switch v := whereNumber(n.operand.eval(values)).(type) {
+	case int64:
+		return -v
+	case float64:
+		return -v
+	}
+	return nil
+}
+
+func (n *whereNegate) typeOf(def map[string]string) string {
+	if whereIsIntType(n.operand.typeOf(def)) {
+		return "int"
+	}
+	return "float"
+}
+
+// whereLogical is `and` or `or`, the right operand is evaluated only if needed.
+type whereLogical struct {
+	and         bool
+	left, right whereNode
+}
+
+func (n *whereLogical) eval(values map[string]interface{}) interface{} {
+	left := whereTruthy(n.left.eval(values))
+	if left != n.and {
+		return left
+	}
+	return whereTruthy(n.right.eval(values))
+}
+
+func (n *whereLogical) typeOf(def map[string]string) string {
+	return "boolean"
+}
+
+type whereBinary struct {
+	op          string
+	left, right whereNode
+}
+
+func (n *whereBinary) eval(values map[string]interface{}) interface{} {
+	left := n.left.eval(values)
+	right := n.right.eval(values)
+	switch n.op {
+	case "==":
+		return whereEqual(left, right)
+	case "!=":
+		return !whereEqual(left, right)
+	case "<", "<=", ">", ">=":
+		c, ok := whereCompare(left, right)
+		if !ok {
+			return false
+		}
+		switch n.op {
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		default:
+			return c >= 0
+		}
+	default:
+		return whereArithmetic(n.op, left, right)
+	}
+}
+
+func (n *whereBinary) typeOf(def map[string]string) string {
+	switch n.op {
+	case "+", "-", "*", "%":
+		left, right := n.left.typeOf(def), n.right.typeOf(def)
+		if whereIsIntType(left) && whereIsIntType(right) {
+			return "int"
+		}
+		if n.op == "+" && left == "string" && right == "string" {
+			return "string"
+		}
+		return "float"
+	case "/":
+		return "float"
+	default:
+		return "boolean"
+	}
+}
+
+// whereMatch is `=~` or `!~`.
+type whereMatch struct {
+	negate  bool
+	operand whereNode
+	// Compiled if the pattern is a literal, otherwise `pattern` is evaluated for each line
+	regex   *regexp.Regexp
+	pattern whereNode
+}
+
+func (n *whereMatch) eval(values map[string]interface{}) interface{} {
+	str, ok := n.operand.eval(values).(string)
+	if !ok {
+		return false
+	}
+	regex := n.regex
+	if regex == nil {
+		pattern, ok := n.pattern.eval(values).(string)
+		if !ok {
+			return false
+		}
+		var serr error
+		regex, serr = regexp.Compile(pattern)
+		if serr != nil {
+			return false
+		}
+	}
+	return regex.MatchString(str) != n.negate
+}
+
+func (n *whereMatch) typeOf(def map[string]string) string {
+	return "boolean"
+}
+
+// whereIn is `in` or `not in`.
+type whereIn struct {
+	negate  bool
+	operand whereNode
+	list    []whereNode
+}
+
+func (n *whereIn) eval(values map[string]interface{}) interface{} {
+	value := n.operand.eval(values)
+	for _, elem := range n.list {
+		if whereEqual(value, elem.eval(values)) {
+			return !n.negate
+		}
+	}
+	return n.negate
+}
+
+func (n *whereIn) typeOf(def map[string]string) string {
+	return "boolean"
+}
+
+// whereIsIntType reports whether values of the type are integers.
+func whereIsIntType(typ string) bool {
+	return typ == "int" || typ == "timestamp" || typ == "duration"
+}
+
+// whereTruthy reports whether the value is regarded as true.
+func whereTruthy(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case int64:
+		return v != 0
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case nil:
+		return false
+	}
+	return true
+}
+
+// whereNumber converts the value to int64 or float64, nil is returned if it is not a number.
+func whereNumber(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int64, float64:
+		return v
+	case int:
+		return int64(v)
+	case string:
+		if i, serr := strconv.ParseInt(v, 10, 64); serr == nil {
+			return i
+		}
+		if f, serr := strconv.ParseFloat(v, 64); serr == nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// whereNumbers converts both values to numbers of the same type.
+func whereNumbers(left, right interface{}) (interface{}, interface{}, bool) {
+	left = whereNumber(left)
+	right = whereNumber(right)
+	if left == nil || right == nil {
+		return nil, nil, false
+	}
+	li, lok := left.(int64)
+	ri, rok := right.(int64)
+	if lok && rok {
+		return li, ri, true
+	}
+	if lok {
+		left = float64(li)
+	}
+	if rok {
+		right = float64(ri)
+	}
+	return left, right, true
+}
+
+// whereCompare returns the sign of `left - right`, false if they can not be compared.
+func whereCompare(left, right interface{}) (int, bool) {
+	ls, lok := left.(string)
+	rs, rok := right.(string)
+	if lok && rok {
+		return strings.Compare(ls, rs), true
+	}
+	ln, rn, ok := whereNumbers(left, right)
+	if !ok {
+		return 0, false
+	}
+	switch l := ln.(type) {
+	case int64:
+		r := rn.(int64)
+		if l < r {
+			return -1, true
+		} else if l > r {
+			return 1, true
+		}
+		return 0, true
+	default:
+		lf, rf := l.(float64), rn.(float64)
+		if lf < rf {
+			return -1, true
+		} else if lf > rf {
+			return 1, true
+		}
+		return 0, true
+	}
+}
+
+func whereEqual(left, right interface{}) bool {
+	if left == nil || right == nil {
+		return left == nil && right == nil
+	}
+	lb, lok := left.(bool)
+	rb, rok := right.(bool)
+	if lok || rok {
+		return lok && rok && lb == rb
+	}
+	c, ok := whereCompare(left, right)
+	return ok && c == 0
+}
+
+func whereArithmetic(op string, left, right interface{}) interface{} {
+	if op == "+" {
+		ls, lok := left.(string)
+		rs, rok := right.(string)
+		if lok && rok && (whereNumber(ls) == nil || whereNumber(rs) == nil) {
+			// Concatenation of non-numeric strings
+			return ls + rs
+		}
+	}
+	ln, rn, ok := whereNumbers(left, right)
+	if !ok {
+		return nil
+	}
+	if l, ok := ln.(int64); ok && op != "/" {
+		r := rn.(int64)
+		switch op {
+		case "+":
+			return l + r
+		case "-":
+			return l - r
+		case "*":
+			return l * r
+		case "%":
+			if r == 0 {
+				return nil
+			}
+			return l % r
+		}
+	}
+	var lf, rf float64
+	if l, ok := ln.(int64); ok {
+		lf, rf = float64(l), float64(rn.(int64))
+	} else {
+		lf, rf = ln.(float64), rn.(float64)
+	}
+	switch op {
+	case "+":
+		return lf + rf
+	case "-":
+		return lf - rf
+	case "*":
+		return lf * rf
+	case "/":
+		if rf == 0 {
+			return nil
+		}
+		return lf / rf
+	case "%":
+		if rf == 0 {
+			return nil
+		}
+		return math.Mod(lf, rf)
+	}
+	return nil
+}
+
+// whereParser is a recursive descent parser of `--where` expressions.
+type whereParser struct {
+	tokens []whereToken
+	pos    int
+}
+
+func (p *whereParser) peek() whereToken {
+	return p.tokens[p.pos]
+}
+
+func (p *whereParser) next() whereToken {
+	token := p.tokens[p.pos]
+	if token.kind != whereTokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+// accept consumes the next token if it is one of `texts`, which are operators or keywords.
+func (p *whereParser) accept(texts ...string) (string, bool) {
+	token := p.peek()
+	if token.kind != whereTokenOperator && token.kind != whereTokenIdent {
+		return "", false
+	}
+	for _, text := range texts {
+		if token.text == text || token.kind == whereTokenIdent && strings.EqualFold(token.text, text) {
+			p.pos++
+			return text, true
+		}
+	}
+	return "", false
+}
+
+func (p *whereParser) unexpected() error {
+	token := p.peek()
+	if token.kind == whereTokenEOF {
+		return fmt.Errorf("position %d: unexpected end of the expression", token.pos)
+	}
+	return fmt.Errorf("position %d: unexpected '%s'", token.pos, token.text)
+}
+
+func (p *whereParser) parseOr() (whereNode, error) {
+	left, serr := p.parseAnd()
+	if serr != nil {
+		return nil, serr
+	}
+	for {
+		if _, ok := p.accept("or", "||"); !ok {
+			return left, nil
+		}
+		right, serr := p.parseAnd()
+		if serr != nil {
+			return nil, serr
+		}
+		left = &whereLogical{and: false, left: left, right: right}
+	}
+}
+
+func (p *whereParser) parseAnd() (whereNode, error) {
+	left, serr := p.parseNot()
+	if serr != nil {
+		return nil, serr
+	}
+	for {
+		if _, ok := p.accept("and", "&&"); !ok {
+			return left, nil
+		}
+		right, serr := p.parseNot()
+		if serr != nil {
+			return nil, serr
+		}
+		left = &whereLogical{and: true, left: left, right: right}
+	}
+}
+
+func (p *whereParser) parseNot() (whereNode, error) {
+	if _, ok := p.accept("not", "!"); ok {
+		operand, serr := p.parseNot()
+		if serr != nil {
+			return nil, serr
+		}
+		return &whereNot{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *whereParser) parseComparison() (whereNode, error) {
+	left, serr := p.parseSum()
+	if serr != nil {
+		return nil, serr
+	}
+	if op, ok := p.accept("==", "=", "!=", "<=", ">=", "<", ">"); ok {
+		right, serr := p.parseSum()
+		if serr != nil {
+			return nil, serr
+		}
+		if op == "=" {
+			op = "=="
+		}
+		return &whereBinary{op: op, left: left, right: right}, nil
+	}
+	if op, ok := p.accept("=~", "!~"); ok {
+		pattern, serr := p.parseSum()
+		if serr != nil {
+			return nil, serr
+		}
+		n := &whereMatch{negate: op == "!~", operand: left, pattern: pattern}
+		if literal, ok := pattern.(*whereLiteral); ok {
+			str, ok := literal.value.(string)
+			if !ok {
+				return nil, fmt.Errorf("regular expression must be a string")
+			}
+			n.regex, serr = regexp.Compile(str)
+			if serr != nil {
+				return nil, serr
+			}
+		}
+		return n, nil
+	}
+	negate := false
+	if _, ok := p.accept("not"); ok {
+		// Only `not in` is allowed here
+		negate = true
+		if p.peek().kind != whereTokenIdent || !strings.EqualFold(p.peek().text, "in") {
+			return nil, p.unexpected()
+		}
+	}
+	if _, ok := p.accept("in"); ok {
+		list, serr := p.parseList()
+		if serr != nil {
+			return nil, serr
+		}
+		return &whereIn{negate: negate, operand: left, list: list}, nil
+	}
+	return left, nil
+}
+
+// parseList parses a list of expressions enclosed by parentheses or brackets.
+func (p *whereParser) parseList() ([]whereNode, error) {
+	open, ok := p.accept("(", "[")
+	if !ok {
+		return nil, p.unexpected()
+	}
+	closing := ")"
+	if open == "[" {
+		closing = "]"
+	}
+	var list []whereNode
+	if _, ok := p.accept(closing); ok {
+		return list, nil
+	}
+	for {
+		elem, serr := p.parseOr()
+		if serr != nil {
+			return nil, serr
+		}
+		list = append(list, elem)
+		if _, ok := p.accept(closing); ok {
+			return list, nil
+		}
+		if _, ok := p.accept(","); !ok {
+			return nil, p.unexpected()
+		}
+	}
+}
+
+func (p *whereParser) parseSum() (whereNode, error) {
+	left, serr := p.parseProduct()
+	if serr != nil {
+		return nil, serr
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		right, serr := p.parseProduct()
+		if serr != nil {
+			return nil, serr
+		}
+		left = &whereBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *whereParser) parseProduct() (whereNode, error) {
+	left, serr := p.parseUnary()
+	if serr != nil {
+		return nil, serr
+	}
+	for {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			return left, nil
+		}
+		right, serr := p.parseUnary()
+		if serr != nil {
+			return nil, serr
+		}
+		left = &whereBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *whereParser) parseUnary() (whereNode, error) {
+	if _, ok := p.accept("-"); ok {
+		operand, serr := p.parseUnary()
+		if serr != nil {
+			return nil, serr
+		}
+		return &whereNegate{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *whereParser) parsePrimary() (whereNode, error) {
+	if _, ok := p.accept("("); ok {
+		inner, serr := p.parseOr()
+		if serr != nil {
+			return nil, serr
+		}
+		if _, ok := p.accept(")"); !ok {
+			return nil, p.unexpected()
+		}
+		return inner, nil
+	}
+	token := p.peek()
+	switch token.kind {
+	case whereTokenNumber:
+		p.next()
+		number := whereNumber(token.text)
+		if number == nil {
+			return nil, fmt.Errorf("position %d: invalid number '%s'", token.pos, token.text)
+		}
+		return &whereLiteral{value: number}, nil
+	case whereTokenString:
+		p.next()
+		return &whereLiteral{value: token.text}, nil
+	case whereTokenIdent:
+		// Keywords can not be field names unless they are quoted with backquotes
+		switch strings.ToLower(token.text) {
+		case "true":
+			p.next()
+			return &whereLiteral{value: true}, nil
+		case "false":
+			p.next()
+			return &whereLiteral{value: false}, nil
+		case "null":
+			p.next()
+			return &whereLiteral{value: nil}, nil
+		case "and", "or", "not", "in":
+			return nil, p.unexpected()
+		}
+		p.next()
+		if _, ok := p.accept("("); ok {
+			if _, ok := whereFunctions[token.text]; !ok {
+				return nil, fmt.Errorf("position %d: unknown function '%s'", token.pos, token.text)
+			}
+			arg, serr := p.parseOr()
+			if serr != nil {
+				return nil, serr
+			}
+			if _, ok := p.accept(")"); !ok {
+				return nil, p.unexpected()
+			}
+			return &whereCall{name: token.text, arg: arg}, nil
+		}
+		return &whereField{name: token.text}, nil
+	case whereTokenQuotedIdent:
+		p.next()
+		return &whereField{name: token.text}, nil
+	}
+	return nil, p.unexpected()
+}
+
+// whereExpr is a parsed `--where` expression.
+type whereExpr struct {
+	root whereNode
+}
+
+// parseWhere parses the expression given by the `--where` option.
+func parseWhere(src string) (*whereExpr, error) {
+	tokens, serr := tokenizeWhere(src)
+	if serr != nil {
+		return nil, fmt.Errorf("--where: %v", serr)
+	}
+	p := &whereParser{tokens: tokens}
+	root, serr := p.parseOr()
+	if serr != nil {
+		return nil, fmt.Errorf("--where: %v", serr)
+	}
+	if p.peek().kind != whereTokenEOF {
+		return nil, fmt.Errorf("--where: %v", p.unexpected())
+	}
+	return &whereExpr{root: root}, nil
+}
+
+// match reports whether the line with `values` satisfies the expression.
+func (w *whereExpr) match(values map[string]interface{}) bool {
+	return whereTruthy(w.root.eval(values))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/exchangedataset/exd-cli/format"
+	"github.com/exchangedataset/exdgo"
+)
+
+// whereValues returns values of a line in the same way as rapid.
+func whereValues() map[string]interface{} {
+	return map[string]interface{}{
+		format.FieldExchange:  "bitmex",
+		format.FieldType:      exdgo.LineTypeMessage,
+		format.FieldChannel:   "trade",
+		format.FieldTimestamp: int64(1598918400000000123),
+		"pair":                "XBTUSD",
+		"side":                "Buy",
+		"price":               11700.5,
+		"size":                int64(100),
+		"価格":                  int64(200),
+	}
+}
+
+func evalWhere(t *testing.T, src string, values map[string]interface{}) interface{} {
+	t.Helper()
+	w, err := parseWhere(src)
+	if err != nil {
+		t.Fatalf("parseWhere(%q): %v", src, err)
+	}
+	return w.root.eval(values)
+}
+
+func TestWhereEval(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		// Precedence and associativity
+		{"1 + 2 * 3", int64(7)},
+		{"(1 + 2) * 3", int64(9)},
+		{"10 - 2 - 3", int64(5)},
+		{"-2 * 3", int64(-6)},
+		{"7 % 4", int64(3)},
+		{"7 / 2", 3.5},
+		{"1 + 2 * 3 == 7", true},
+		{"true or false and false", true},
+		{"(true or false) and false", false},
+		{"not false and false", false},
+		{"!(size > 10) || size == 100", true},
+		{"size > 10 && price < 20000", true},
+		// in
+		{"side in (\"Buy\", \"Sell\")", true},
+		{"side in ['Sell']", false},
+		{"side not in ('Sell')", true},
+		{"side in ()", false},
+		{"size in (\"100\", 200)", true},
+		{"missing in (null)", true},
+		// Functions
+		{"iso(line_timestamp)", "2020-09-01T00:00:00.000000123Z"},
+		{"ms(line_timestamp)", int64(1598918400000)},
+		{"ms(line_timestamp) % 1000", int64(0)},
+		{"iso(pair)", nil},
+		// Regular expressions
+		{"pair =~ \"^XBT\"", true},
+		{"pair !~ '^XBT'", false},
+		{"size =~ \"1\"", false},
+		// Type mismatches and null
+		{"price > \"abc\"", false},
+		{"price == \"11700.5\"", true},
+		{"missing > 1", false},
+		{"missing == null", true},
+		{"missing != null", false},
+		{"side + 1", nil},
+		{"\"a\" + \"b\"", "ab"},
+		{"\"1\" + 2", int64(3)},
+		{"true == 1", false},
+		{"size * price", 1170050.0},
+		{"size / 0", nil},
+		{"size % 0", nil},
+		{"line_type == \"msg\"", true},
+		// Names other than ASCII
+		{"価格 > 100", true},
+		{"pair == \"ビットコイン\"", false},
+		{"`価格` * 2", int64(400)},
+	}
+	for _, test := range tests {
+		if got := evalWhere(t, test.src, whereValues()); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s = %#v, want %#v", test.src, got, test.want)
+		}
+	}
+}
+
+// TestWhereTimestamp checks that timestamps are compared as numbers, even with strings.
+func TestWhereTimestamp(t *testing.T) {
+	tests := []struct {
+		src  string
+		want interface{}
+	}{
+		{"line_timestamp > 1598918400000000000", true},
+		{"line_timestamp == 1598918400000000123", true},
+		{"line_timestamp == \"1598918400000000123\"", true},
+		{"line_timestamp > \"999\"", true},
+		{"line_timestamp < \"2\"", false},
+		{"line_timestamp + 1", int64(1598918400000000124)},
+		{"line_timestamp in (1598918400000000123)", true},
+	}
+	for _, test := range tests {
+		if got := evalWhere(t, test.src, whereValues()); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s = %#v, want %#v", test.src, got, test.want)
+		}
+	}
+}
+
+func TestWhereMatch(t *testing.T) {
+	w, err := parseWhere("size >= 100 and pair == 'XBTUSD'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := whereValues()
+	if !w.match(values) {
+		t.Error("the line does not match")
+	}
+	values["size"] = int64(99)
+	if w.match(values) {
+		t.Error("the line matches")
+	}
+}
+
+func TestWhereErrors(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"price >",
+		"(price > 1",
+		"price > 1)",
+		"price in 1",
+		// Comparisons are not chained
+		"1 < 2 == true",
+		"price in (1, 2",
+		"foo(1)",
+		"iso(1, 2)",
+		"\"abc",
+		"`abc",
+		"price @ 1",
+		"and",
+		"price not 1",
+		"price =~ 1",
+		"price =~ \"(\"",
+		"1.2.3",
+		"price \xff",
+	} {
+		if _, err := parseWhere(src); err == nil {
+			t.Errorf("parseWhere(%q) succeeded", src)
+		}
+	}
+}
+
+func TestWhereTypeOf(t *testing.T) {
+	def := map[string]string{"price": "float", "size": "int", "pair": "string"}
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"size * 2", "int"},
+		{"size * price", "float"},
+		{"size / 2", "float"},
+		{"-size", "int"},
+		{"pair + pair", "string"},
+		{"line_timestamp", "timestamp"},
+		{"line_timestamp - 1", "int"},
+		{"iso(line_timestamp)", "string"},
+		{"ms(line_timestamp)", "int"},
+		{"size > 1", "boolean"},
+		{"side in ('Buy')", "boolean"},
+		{"missing", "string"},
+	}
+	for _, test := range tests {
+		w, err := parseWhere(test.src)
+		if err != nil {
+			t.Errorf("parseWhere(%q): %v", test.src, err)
+			continue
+		}
+		if got := w.root.typeOf(def); got != test.want {
+			t.Errorf("typeOf(%s) = %s, want %s", test.src, got, test.want)
+		}
+	}
+}